@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	"github.com/spf13/cobra"
+)
+
+var (
+	answerFileOut string
+
+	// Definition of the answerfile subcommand
+	answerFileCmd = &cobra.Command{
+		Use:   "answerfile <alpine-data file | ->",
+		Short: "Convert alpine-data to a setup-alpine answerfile",
+		Long: `Reads an alpine-data file (or stdin when '-' is given), and writes the
+equivalent setup-alpine answerfile to stdout, or the file given with --output.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var data []byte
+			var err error
+			if args[0] == "-" {
+				data, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, err = ioutil.ReadFile(args[0])
+			}
+			if err != nil {
+				return err
+			}
+
+			out := os.Stdout
+			if answerFileOut != "" {
+				if out, err = os.Create(answerFileOut); err != nil {
+					return err
+				}
+				defer out.Close()
+			}
+			return lift.WriteAnswerFile(data, out)
+		},
+	}
+)
+
+func init() {
+	answerFileCmd.Flags().StringVarP(&answerFileOut, "output", "o", "", "write the answerfile to this file instead of stdout")
+	RootCmd.AddCommand(answerFileCmd)
+}
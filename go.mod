@@ -4,7 +4,6 @@ go 1.15
 
 require (
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/mitchellh/go-ps v1.0.0
 	github.com/moby/sys/mountinfo v0.6.2
 	github.com/sirupsen/logrus v1.9.1
 	github.com/spf13/cobra v1.7.0
@@ -0,0 +1,452 @@
+package lift
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	apkKeysDir          = "/etc/apk/keys"
+	apkRepositoriesFile = "/etc/apk/repositories"
+	apkCacheLink        = "/etc/apk/cache"
+	defaultAPKCacheDir  = "/var/cache/apk"
+	alpineReleaseFile   = "/etc/alpine-release"
+	defaultMirror       = "http://dl-cdn.alpinelinux.org/alpine"
+	// timeout for checking if a remote repository is reachable
+	repoProbeTimeout = 5 * time.Second
+)
+
+var (
+	// matches the requested packages in apk's "required by: world[pkg]" errors
+	worldDepRegexp = regexp.MustCompile(`world\[([^\]]+)\]`)
+)
+
+// returns the tags defined by tagged repositories (e.g. "@edge http://...")
+func repositoryTags(repos []string) map[string]bool {
+	tags := make(map[string]bool)
+	for _, r := range repos {
+		r = strings.TrimSpace(r)
+		if strings.HasPrefix(r, "@") {
+			tags[strings.Fields(r)[0][1:]] = true
+		}
+	}
+	return tags
+}
+
+// returns the repository tag of a package spec like pkg@edge or pkg@edge=1.2,
+// or an empty string when the package isn't pinned to a tagged repository
+func packageTag(spec string) string {
+	i := strings.Index(spec, "@")
+	if i < 0 {
+		return ""
+	}
+	tag := spec[i+1:]
+	if j := strings.IndexAny(tag, "=<>~"); j >= 0 {
+		tag = tag[:j]
+	}
+	return tag
+}
+
+// checks that all tagged packages refer to a tagged repository
+func checkPackageTags(repos, packages []string) error {
+	tags := repositoryTags(repos)
+	for _, p := range packages {
+		if t := packageTag(p); t != "" && !tags[t] {
+			return fmt.Errorf("package %s refers to unknown repository tag @%s", p, t)
+		}
+	}
+	return nil
+}
+
+// installs repository signing keys into /etc/apk/keys
+func installAPKKeys(keys []APKKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(apkKeysDir, 0755); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		name := k.Name
+		if name == "" && k.URL != "" {
+			name = path.Base(k.URL)
+		}
+		if name == "" || name == "." || name == "/" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid apk key name %q", name)
+		}
+		data := []byte(k.Content)
+		if k.URL != "" {
+			var err error
+			log.WithField("url", k.URL).Debug("Downloading apk key")
+			if data, err = downloadFile(k.URL, nil); err != nil {
+				return err
+			}
+		}
+		if !strings.Contains(string(data), "BEGIN PUBLIC KEY") {
+			return fmt.Errorf("apk key %s is not a PEM encoded public key", name)
+		}
+		log.Infof("Installing apk key %s", name)
+		if err := ioutil.WriteFile(filepath.Join(apkKeysDir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes the repositories, installs signing keys and (un)installs packages
+func (l *Lift) setupAPK() error {
+	if l.Data.Packages == nil {
+		return nil
+	}
+	if err := checkPackageTags(l.Data.Packages.Repositories, l.Data.Packages.Install); err != nil {
+		return err
+	}
+	if err := installAPKKeys(l.Data.Packages.Keys); err != nil {
+		return err
+	}
+	repos, err := resolveRepositories(l.Data.Packages)
+	if err != nil {
+		return err
+	}
+	if len(repos) > 0 {
+		rfile, err := generateFileFromTemplate(*repoFile, repos)
+		if err != nil {
+			return err
+		}
+		log.Debug("Setting up repositories")
+		cmd := exec.Command("mv", rfile, apkRepositoriesFile)
+		if err = cmd.Run(); err != nil {
+			return err
+		}
+	} else {
+		log.Debug("No repositories specified; keeping current repositories")
+	}
+	if l.Data.Packages.Cache != nil {
+		if err = setupAPKCache(l.Data.Packages.Cache); err != nil {
+			return err
+		}
+	}
+	if err = l.offlineAPKOptions(); err != nil {
+		return err
+	}
+	if l.Data.Packages.Update {
+		if _, err = l.runAPK("update"); err != nil {
+			return err
+		}
+	}
+	if l.Data.Packages.Upgrade {
+		if _, err = l.runAPK("upgrade"); err != nil {
+			return err
+		}
+	}
+	if len(l.Data.Packages.Uninstall) > 0 {
+		if _, err = l.runAPK(append([]string{"del"}, l.Data.Packages.Uninstall...)...); err != nil {
+			return err
+		}
+	}
+	if len(l.Data.Packages.Install) > 0 {
+		out, err := l.runAPK(append([]string{"add"}, l.Data.Packages.Install...)...)
+		if err != nil {
+			if failed := unresolvedPackages(out); len(failed) > 0 {
+				l.Report.Add("packages", fmt.Sprintf("unable to resolve: %s", strings.Join(failed, " ")))
+				return fmt.Errorf("apk add: unable to resolve %s", strings.Join(failed, ", "))
+			}
+			return err
+		}
+		l.Report.Add("packages", fmt.Sprintf("installed: %s", strings.Join(l.Data.Packages.Install, " ")))
+	}
+	return nil
+}
+
+// installs packages lift itself needs, e.g. filesystem tools or the MTA,
+// with the same local repository and offline options as `packages:`.
+// Lift may need them before the `packages:` block is set up, in which
+// case these options are determined first.
+func (l *Lift) apkAdd(pkgs ...string) error {
+	var names []string
+	for _, p := range pkgs {
+		if p != "" {
+			names = append(names, p)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if !l.apkOptionsSet && l.Data.Packages != nil {
+		if err := l.offlineAPKOptions(); err != nil {
+			return err
+		}
+	}
+	if _, err := l.runAPK(append([]string{"add"}, names...)...); err != nil {
+		return err
+	}
+	l.Report.Add("packages", fmt.Sprintf("installed for lift: %s", strings.Join(names, " ")))
+	return nil
+}
+
+// runs apk with the given arguments as a single transaction. Its output is
+// logged and returned, and added to the run report for add and del, and on
+// failure.
+func (l *Lift) runAPK(args ...string) (string, error) {
+	cmdline := fmt.Sprintf("apk %s", strings.Join(args, " "))
+	log.Debugf("exec: %s", cmdline)
+	out, err := exec.Command("apk", append(l.apkOptions, args...)...).CombinedOutput()
+	trimmed := strings.TrimSpace(string(out))
+	for _, line := range strings.Split(trimmed, "\n") {
+		if line != "" {
+			log.WithField("cmd", "apk").Info(line)
+		}
+	}
+	if err != nil {
+		l.Report.Add("packages", fmt.Sprintf("%s failed: %v", cmdline, err), trimmed)
+		return string(out), fmt.Errorf("%s: %v", cmdline, err)
+	}
+	if args[0] == "add" || args[0] == "del" {
+		lines := []string{fmt.Sprintf("$ %s [ok]", cmdline)}
+		if trimmed != "" {
+			lines = append(lines, trimmed)
+		}
+		l.Report.Add("packages", lines...)
+	}
+	return string(out), nil
+}
+
+// extracts the requested packages apk could not resolve from its output, e.g.
+//
+//	ERROR: unable to select packages:
+//	  foo (no such package):
+//	    required by: world[foo]
+func unresolvedPackages(out string) []string {
+	var failed []string
+	seen := make(map[string]bool)
+	for _, m := range worldDepRegexp.FindAllStringSubmatch(out, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			failed = append(failed, m[1])
+		}
+	}
+	return failed
+}
+
+// enables the apk cache by linking /etc/apk/cache to the cache directory,
+// and seeds it with the packages found in the seed directories
+func setupAPKCache(c *APKCache) error {
+	dir := c.Directory
+	if dir == "" {
+		dir = defaultAPKCacheDir
+	}
+	fi, err := os.Lstat(apkCacheLink)
+	switch {
+	case err == nil && fi.IsDir():
+		// an existing cache directory may hold cached packages; keep it
+		if dir != apkCacheLink {
+			log.Warnf("%s is a directory; using it as apk cache instead of %s", apkCacheLink, dir)
+		}
+		dir = apkCacheLink
+	case err == nil && fi.Mode()&os.ModeSymlink == 0:
+		return fmt.Errorf("apk cache: %s is not a directory or symlink", apkCacheLink)
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	log.Infof("Enabling apk cache in %s", dir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if dir != apkCacheLink {
+		if target, err := os.Readlink(apkCacheLink); err != nil || target != dir {
+			// only a symlink (or nothing) is replaced
+			if err := os.Remove(apkCacheLink); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(dir, apkCacheLink); err != nil {
+				return err
+			}
+		}
+	}
+	for _, seed := range expandGlobs(c.Seed) {
+		apks, _ := filepath.Glob(filepath.Join(seed, "*.apk"))
+		log.Debugf("Seeding apk cache with %d packages from %s", len(apks), seed)
+		for _, apk := range apks {
+			data, err := ioutil.ReadFile(apk)
+			if err != nil {
+				return err
+			}
+			if err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(apk)), data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// determines the global apk options lift uses to install packages without
+// network access: local repositories are added with --repository, and when
+// remote repositories are unreachable they are left out, or if none is
+// reachable, apk runs with --no-network to use the cache.
+func (l *Lift) offlineAPKOptions() error {
+	p := l.Data.Packages
+	l.apkOptions = nil
+	l.apkOptionsSet = true
+	locals := expandGlobs(p.LocalRepositories)
+	for _, dir := range locals {
+		log.Infof("Using local repository %s", dir)
+		l.apkOptions = append(l.apkOptions, "--repository", dir)
+	}
+	if len(locals) == 0 && p.Cache == nil {
+		return nil
+	}
+
+	arch, err := exec.Command("apk", "--print-arch").Output()
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadFile(apkRepositoriesFile)
+	if err != nil {
+		return err
+	}
+	var reachable, unreachable []string
+	for _, r := range strings.Split(string(current), "\n") {
+		if r = strings.TrimSpace(r); r == "" || strings.HasPrefix(r, "#") {
+			continue
+		}
+		url := strings.TrimSpace(r)
+		if strings.HasPrefix(url, "@") {
+			url = strings.TrimSpace(strings.TrimPrefix(url, strings.Fields(url)[0]))
+		}
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			reachable = append(reachable, r)
+			continue
+		}
+		index := fmt.Sprintf("%s/%s/APKINDEX.tar.gz", strings.TrimSuffix(url, "/"), strings.TrimSpace(string(arch)))
+		if urlReachable(index, repoProbeTimeout) {
+			reachable = append(reachable, r)
+		} else {
+			log.Warnf("Repository %s is unreachable", url)
+			unreachable = append(unreachable, r)
+		}
+	}
+	if len(unreachable) == 0 {
+		return nil
+	}
+	l.Report.Add("packages", fmt.Sprintf("unreachable repositories: %s", strings.Join(unreachable, ", ")))
+
+	if len(reachable) == 0 && p.Cache != nil {
+		log.Info("No repository reachable; using the apk cache only")
+		l.apkOptions = append(l.apkOptions, "--no-network")
+		return nil
+	}
+	rfile, err := generateFileFromTemplate(*repoFile, reachable)
+	if err != nil {
+		return err
+	}
+	l.apkOptions = append(l.apkOptions, "--repositories-file", rfile)
+	return nil
+}
+
+// expands shell patterns (e.g. /media/*/apks) to the existing paths
+func expandGlobs(patterns []string) []string {
+	var paths []string
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil || len(matches) == 0 {
+			log.Debugf("No match for %s", p)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// returns the repositories to write to /etc/apk/repositories. Explicit
+// repositories are used as is. Otherwise, when a mirror (or a list of
+// mirrors to pick the fastest from) is set, the main and community
+// repositories of the running Alpine release are used. Returns nothing
+// when the current repositories should be kept.
+func resolveRepositories(p *PackagesConfig) ([]string, error) {
+	if len(p.Repositories) > 0 {
+		return p.Repositories, nil
+	}
+	if p.Mirror == "" && len(p.Mirrors) == 0 {
+		return nil, nil
+	}
+	branch, err := alpineBranch()
+	if err != nil {
+		return nil, err
+	}
+	mirror := p.Mirror
+	if len(p.Mirrors) > 0 {
+		if mirror, err = fastestMirror(p.Mirrors, branch); err != nil {
+			mirror = p.Mirror
+			if mirror == "" {
+				mirror = defaultMirror
+			}
+			log.Warnf("%v; using %s", err, mirror)
+		}
+	}
+	mirror = strings.TrimSuffix(mirror, "/")
+	log.WithFields(log.Fields{
+		"mirror": mirror,
+		"branch": branch,
+	}).Info("Using default repositories")
+	return []string{
+		fmt.Sprintf("%s/%s/main", mirror, branch),
+		fmt.Sprintf("%s/%s/community", mirror, branch),
+	}, nil
+}
+
+// returns the repository branch (e.g. v3.18 or edge) of the running
+// Alpine release, read from /etc/alpine-release
+func alpineBranch() (string, error) {
+	data, err := ioutil.ReadFile(alpineReleaseFile)
+	if err != nil {
+		return "", err
+	}
+	release := strings.TrimSpace(string(data))
+	// development snapshots look like 3.19_alpha20231016
+	if strings.Contains(release, "_") || release == "edge" {
+		return "edge", nil
+	}
+	parts := strings.Split(release, ".")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("unexpected Alpine release %q", release)
+	}
+	return fmt.Sprintf("v%s.%s", parts[0], parts[1]), nil
+}
+
+// returns the mirror that serves the main APKINDEX of the branch the fastest
+func fastestMirror(mirrors []string, branch string) (string, error) {
+	arch, err := exec.Command("apk", "--print-arch").Output()
+	if err != nil {
+		return "", err
+	}
+	fastest := ""
+	var best time.Duration
+	for _, m := range mirrors {
+		m = strings.TrimSuffix(m, "/")
+		index := fmt.Sprintf("%s/%s/main/%s/APKINDEX.tar.gz", m, branch, strings.TrimSpace(string(arch)))
+		start := time.Now()
+		if !urlReachable(index, repoProbeTimeout) {
+			log.Debugf("Mirror %s is unreachable", m)
+			continue
+		}
+		d := time.Since(start)
+		log.Debugf("Mirror %s responded in %s", m, d)
+		if fastest == "" || d < best {
+			fastest, best = m, d
+		}
+	}
+	if fastest == "" {
+		return "", errors.New("none of the mirrors is reachable")
+	}
+	return fastest, nil
+}
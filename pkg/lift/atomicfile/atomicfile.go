@@ -0,0 +1,41 @@
+// Package atomicfile writes files atomically, through a temporary file in
+// the same directory that is renamed into place.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Write atomically writes data to path, through a temporary file in the
+// same directory that is renamed into place. When prepare is not nil, it is
+// called with the name of the temporary file before the rename, e.g. to
+// change its owner or validate it; an error leaves path untouched.
+func Write(path string, data []byte, perm os.FileMode, prepare func(tmp string) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".lift-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if prepare != nil {
+		if err = prepare(tmp.Name()); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,60 @@
+package atomicfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	tests := []struct {
+		name    string
+		data    string
+		prepare func(string) error
+		wantErr bool
+		want    string
+	}{
+		{"new file", "one\n", nil, false, "one\n"},
+		{"replaced", "two\n", func(string) error { return nil }, false, "two\n"},
+		{"prepare fails", "three\n", func(string) error { return errors.New("invalid") }, true, "two\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Write(path, []byte(tt.data), 0640, tt.prepare)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("got %q, want %q", b, tt.want)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("mode %v, want 0640", fi.Mode().Perm())
+			}
+		})
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %d entries", len(entries))
+	}
+}
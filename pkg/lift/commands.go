@@ -0,0 +1,157 @@
+package lift
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pause between attempts of a failing command
+	commandRetryDelay = 2 * time.Second
+)
+
+// String returns the command line, for logging
+func (cl CommandLine) String() string {
+	if cl.Shell {
+		return fmt.Sprintf("sh -c %q", strings.Join(cl.Args, " "))
+	}
+	return strings.Join(cl.Args, " ")
+}
+
+// runs a list of commands (e.g. runcmd) in order. Their output is logged and
+// added to the run report under the given module name. Returns the error of
+// the first command that fails, unless it has ignore_errors set.
+func (l *Lift) runCommands(module string, cmds []Command) error {
+	for _, c := range cmds {
+		if len(c.Cmd.Args) == 0 {
+			return fmt.Errorf("%s: command without cmd", module)
+		}
+		attempts := c.Retries + 1
+		var err error
+		for i := 1; i <= attempts; i++ {
+			var out string
+			out, err = runCommand(c)
+			l.logCommand(module, c, out, err)
+			if err == nil {
+				break
+			}
+			if i < attempts {
+				log.Infof("Retrying %s (%d/%d)", c.Cmd, i, c.Retries)
+				time.Sleep(commandRetryDelay)
+			}
+		}
+		if err != nil {
+			if c.IgnoreErrors {
+				log.Warnf("Ignoring error of %s: %v", c.Cmd, err)
+				continue
+			}
+			return fmt.Errorf("%s: %s: %v", module, c.Cmd, err)
+		}
+	}
+	return nil
+}
+
+// logs the output of a command, and adds it to the run report
+func (l *Lift) logCommand(module string, c Command, out string, err error) {
+	out = strings.TrimRight(out, "\n")
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			log.WithField("cmd", c.Cmd.Args[0]).Info(line)
+		}
+	}
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	lines := []string{fmt.Sprintf("$ %s [%s]", c.Cmd, status)}
+	if out != "" {
+		lines = append(lines, out)
+	}
+	l.Report.Add(module, lines...)
+}
+
+// runs a single command, optionally as another user, in another working
+// directory, with extra environment variables and a timeout. Returns the
+// combined stdout and stderr.
+func runCommand(c Command) (string, error) {
+	var cmd *exec.Cmd
+	if c.Cmd.Shell {
+		cmd = exec.Command("sh", "-c", strings.Join(c.Cmd.Args, " "))
+	} else {
+		cmd = exec.Command(c.Cmd.Args[0], c.Cmd.Args[1:]...)
+	}
+	cmd.Dir = c.Cwd
+	cmd.Env = os.Environ()
+	// run in its own process group, so a timeout kills its children too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if c.User != "" {
+		u, err := lookupPasswd(c.User)
+		if err != nil {
+			return "", err
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(u.UID), Gid: uint32(u.GID)}
+		cmd.Env = append(cmd.Env, "HOME="+u.Home, "USER="+u.Name, "LOGNAME="+u.Name)
+	}
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, c.Env[k]))
+	}
+
+	// output goes to a file instead of a pipe, so Wait returns when the
+	// command exits, even when it leaves children running in the background
+	out, err := ioutil.TempFile("", "lift-cmd-*")
+	if err != nil {
+		return "", err
+	}
+	os.Remove(out.Name())
+	defer out.Close()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	log.Debugf("exec: %s", c.Cmd)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		t := time.NewTimer(time.Duration(c.Timeout) * time.Second)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case err = <-done:
+	case <-timeout:
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = fmt.Errorf("timed out after %ds", c.Timeout)
+	}
+	return readOutput(out), err
+}
+
+// reads the output written to a command's output file
+func readOutput(f *os.File) string {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
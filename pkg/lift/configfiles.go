@@ -0,0 +1,83 @@
+package lift
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/kvfile"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	configFileFormats = map[string]kvfile.Format{
+		"shell":  kvfile.Shell,
+		"equals": kvfile.Equals,
+		"space":  kvfile.Space,
+		"colon":  kvfile.Colon,
+	}
+)
+
+// returns the format of a `config_files:` entry; OpenRC's /etc/conf.d/*
+// and /etc/rc.conf default to shell variables, anything else to key=value
+func configFileFormat(cf ConfigFile) (kvfile.Format, error) {
+	name := strings.ToLower(cf.Format)
+	if name == "" {
+		if strings.HasPrefix(cf.Path, "/etc/conf.d/") || cf.Path == "/etc/rc.conf" {
+			name = "shell"
+		} else {
+			name = "equals"
+		}
+	}
+	format, ok := configFileFormats[name]
+	if !ok {
+		return format, fmt.Errorf("unknown config file format %s for %s", cf.Format, cf.Path)
+	}
+	return format, nil
+}
+
+// applies a single key/value configuration file edit, and returns its diff
+func editConfigFile(cf ConfigFile) (string, error) {
+	format, err := configFileFormat(cf)
+	if err != nil {
+		return "", err
+	}
+	f, err := kvfile.Load(cf.Path, format)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(cf.Settings))
+	for k := range cf.Settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.Set(k, cf.Settings[k])
+	}
+	for _, k := range cf.Remove {
+		f.Delete(k)
+	}
+	if !f.Changed() {
+		return "", nil
+	}
+	diff := f.Diff()
+	return diff, f.Save()
+}
+
+// applies the `config_files:` block
+func (l *Lift) configFilesSetup() error {
+	for _, cf := range l.Data.ConfigFiles {
+		log.Infof("Editing %s", cf.Path)
+		diff, err := editConfigFile(cf)
+		if err != nil {
+			return fmt.Errorf("editing %s: %v", cf.Path, err)
+		}
+		if diff == "" {
+			log.Debugf("%s unchanged", cf.Path)
+			continue
+		}
+		log.Debugf("Changes to %s:\n%s", cf.Path, diff)
+		l.Report.Add("config files", fmt.Sprintf("%s:", cf.Path), strings.TrimSuffix(diff, "\n"))
+	}
+	return nil
+}
@@ -1,27 +1,39 @@
 package lift
 
 import (
+	"errors"
 	"strconv"
 )
 
 // AlpineData is the main alpine-data yaml specification
 type AlpineData struct {
-	RootPasswd  string            `yaml:"password"`
-	MOTD        string            `yaml:"motd"`
-	Network     *NetworkSettings  `yaml:"network"`
-	Packages    *PackagesConfig   `yaml:"packages"`
-	DRP         *DRProvision      `yaml:"dr_provision"`
-	SSHDConfig  *SSHD             `yaml:"sshd"`
-	Groups      MultiString       `yaml:"groups"`
-	Users       []User            `yaml:"users"`
-	RunCMD      []MultiString     `yaml:"runcmd"`
-	WriteFiles  []WriteFile       `yaml:"write_files"`
-	TimeZone    string            `yaml:"timezone"`
-	Keymap      string            `yaml:"keymap"`
-	UnLift      bool              `yaml:"unlift"`
-	ScratchDisk string            `yaml:"scratch_disk"`
-	Disks       []Disk            `yaml:"disks"`
-	MTA         *MTAConfiguration `yaml:"mta"`
+	RootPasswd       string             `yaml:"password"`
+	RootHashedPasswd string             `yaml:"hashed_password"`
+	MOTD             string             `yaml:"motd"`
+	Network          *NetworkSettings   `yaml:"network"`
+	Packages         *PackagesConfig    `yaml:"packages"`
+	DRP              *DRProvision       `yaml:"dr_provision"`
+	SSHDConfig       *SSHD              `yaml:"sshd"`
+	Groups           MultiString        `yaml:"groups"`
+	Users            []User             `yaml:"users"`
+	RunCMD           []Command          `yaml:"runcmd"`
+	BootCMD          []Command          `yaml:"bootcmd"`
+	BootCMDEveryBoot bool               `yaml:"bootcmd_every_boot"`
+	InstanceID       string             `yaml:"instance_id"`
+	WriteFiles       []WriteFile        `yaml:"write_files"`
+	TimeZone         string             `yaml:"timezone"`
+	Keymap           string             `yaml:"keymap"`
+	UnLift           bool               `yaml:"unlift"`
+	ScratchDisk      *ScratchDiskConfig `yaml:"scratch_disk"`
+	Disks            []Disk             `yaml:"disks"`
+	MTA              *MTAConfiguration  `yaml:"mta"`
+	GrowPart         *GrowPartConfig    `yaml:"growpart"`
+	SSHKeySources    map[string]string  `yaml:"ssh_key_sources"`
+	ConfigFiles      []ConfigFile       `yaml:"config_files"`
+	Services         []Service          `yaml:"services"`
+	LBU              *LBUConfig         `yaml:"lbu"`
+	Install          *InstallConfig     `yaml:"install"`
+	Scripts          *ScriptsConfig     `yaml:"scripts"`
 }
 
 // User specifies a specific OS user
@@ -36,16 +48,53 @@ type User struct {
 	System            bool        `yaml:"system"`
 	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys"`
 	Password          string      `yaml:"passwd"`
+	HashedPassword    string      `yaml:"hashed_passwd"`
+	LockPassword      bool        `yaml:"lock_passwd"`
+	ExpirePassword    bool        `yaml:"expire"`
+	PasswordMaxAge    int         `yaml:"password_max_age"`
+	ExpireDate        string      `yaml:"expiredate"`
+	Sudo              MultiString `yaml:"sudo"`
+	Doas              MultiString `yaml:"doas"`
+	SSHImportID       MultiString `yaml:"ssh_import_id"`
 }
 
 // SSHD specifies the `sshd` entry
 type SSHD struct {
-	Port                   int      `yaml:"port"`
-	ListenAddress          string   `yaml:"listen_address"`
-	AuthorizedKeys         []string `yaml:"authorized_keys"`
-	PermitRootLogin        bool     `yaml:"permit_root_login"`
-	PermitEmptyPasswords   bool     `yaml:"permit_empty_passwords"`
-	PasswordAuthentication bool     `yaml:"password_authentication"`
+	Port                   int                    `yaml:"port"`
+	ListenAddress          string                 `yaml:"listen_address"`
+	AuthorizedKeys         []string               `yaml:"authorized_keys"`
+	PermitRootLogin        bool                   `yaml:"permit_root_login"`
+	PermitEmptyPasswords   bool                   `yaml:"permit_empty_passwords"`
+	PasswordAuthentication bool                   `yaml:"password_authentication"`
+	HostKeys               *SSHHostKeys           `yaml:"host_keys"`
+	Options                map[string]MultiString `yaml:"options"`
+	Match                  []SSHDMatch            `yaml:"match"`
+	AllowUsers             MultiString            `yaml:"allow_users"`
+	AllowGroups            MultiString            `yaml:"allow_groups"`
+	Ciphers                MultiString            `yaml:"ciphers"`
+	KexAlgorithms          MultiString            `yaml:"kex_algorithms"`
+	MACs                   MultiString            `yaml:"macs"`
+	SSHImportID            MultiString            `yaml:"ssh_import_id"`
+}
+
+// SSHDMatch is a conditional sshd_config Match block
+type SSHDMatch struct {
+	Criteria string                 `yaml:"criteria"`
+	Options  map[string]MultiString `yaml:"options"`
+}
+
+// SSHHostKeys specifies the `sshd.host_keys:` block. Keys of the types in
+// Regenerate are deleted and generated anew; Keys are installed as given.
+type SSHHostKeys struct {
+	Regenerate MultiString  `yaml:"regenerate"`
+	Keys       []SSHHostKey `yaml:"keys"`
+}
+
+// SSHHostKey is a supplied sshd host key pair
+type SSHHostKey struct {
+	Type    string `yaml:"type"`
+	Private string `yaml:"private"`
+	Public  string `yaml:"public"`
 }
 
 // DRProvision is used for installing and configuring drpcli
@@ -62,55 +111,317 @@ type NetworkSettings struct {
 	HostName      string               `yaml:"hostname"`
 	InterfaceOpts string               `yaml:"interfaces"`
 	ResolvConf    *ResolvConfiguration `yaml:"resolv_conf"`
-	Proxy         string               `yaml:"proxy"`
+	Proxy         *ProxyConfig         `yaml:"proxy"`
 	NTP           *NTPConfiguration    `yaml:"ntp"`
 }
 
-// ResolvConfiguration contains the DNS spec
+// ResolvConfiguration contains the DNS spec. Cache is an optional local
+// caching resolver (unbound or dnsmasq) forwarding to the nameservers.
+// Protect keeps udhcpc from overwriting resolv.conf, and is enabled by
+// default.
 type ResolvConfiguration struct {
-	NameServers   MultiString `yaml:"nameservers"`
-	SearchDomains MultiString `yaml:"search_domains"`
-	Domain        string      `yaml:"domain"`
+	NameServers   MultiString    `yaml:"nameservers"`
+	SearchDomains MultiString    `yaml:"search_domains"`
+	Domain        string         `yaml:"domain"`
+	Options       *ResolvOptions `yaml:"options"`
+	Cache         string         `yaml:"cache"`
+	Protect       *bool          `yaml:"protect"`
+}
+
+// ResolvOptions are the resolver options of resolv.conf
+type ResolvOptions struct {
+	NDots    *int `yaml:"ndots"`
+	Timeout  *int `yaml:"timeout"`
+	Attempts *int `yaml:"attempts"`
+	Rotate   bool `yaml:"rotate"`
 }
 
-// NTPConfiguration is used for configuring chronyd
+// ProxyConfig specifies the `proxy:` block. HTTPS defaults to the HTTP proxy.
+type ProxyConfig struct {
+	HTTP    string      `yaml:"http"`
+	HTTPS   string      `yaml:"https"`
+	NoProxy MultiString `yaml:"no_proxy"`
+}
+
+// UnmarshalYAML allows the proxy to be specified as just a URL, which is
+// used for both http and https
+func (p *ProxyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*p = ProxyConfig{HTTP: url}
+		return nil
+	}
+	type plain ProxyConfig
+	return unmarshal((*plain)(p))
+}
+
+// NTPConfiguration is used for configuring the NTP client: chronyd
+// (default), openntpd or busybox ntpd. RTC is rtcsync (default), hwclock
+// or none. WaitSync is the time in seconds to wait for the clock to be
+// synchronized before continuing.
 type NTPConfiguration struct {
-	Pools   MultiString `yaml:"pools"`
-	Servers MultiString `yaml:"servers"`
+	Client   string       `yaml:"client"`
+	Pools    NTPSources   `yaml:"pools"`
+	Servers  NTPSources   `yaml:"servers"`
+	MakeStep *NTPMakeStep `yaml:"makestep"`
+	Allow    MultiString  `yaml:"allow"`
+	Deny     MultiString  `yaml:"deny"`
+	RTC      string       `yaml:"rtc"`
+	WaitSync int          `yaml:"wait_sync"`
+}
+
+// NTPSource is an NTP server or pool, with its chrony source options.
+// IBurst is enabled unless it's set to false.
+type NTPSource struct {
+	Address    string `yaml:"address"`
+	IBurst     *bool  `yaml:"iburst"`
+	Prefer     bool   `yaml:"prefer"`
+	NTS        bool   `yaml:"nts"`
+	MinPoll    *int   `yaml:"minpoll"`
+	MaxPoll    *int   `yaml:"maxpoll"`
+	MaxSources int    `yaml:"maxsources"`
+}
+
+// UnmarshalYAML allows an NTPSource to be specified as just an address
+func (s *NTPSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*s = NTPSource{Address: address}
+		return nil
+	}
+	type plain NTPSource
+	return unmarshal((*plain)(s))
+}
+
+// NTPSources is a list of NTP sources
+type NTPSources []NTPSource
+
+// UnmarshalYAML allows NTPSources to be a single source, or a list of sources
+func (ns *NTPSources) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sources []NTPSource
+	if err := unmarshal(&sources); err == nil {
+		*ns = sources
+		return nil
+	}
+	var source NTPSource
+	if err := unmarshal(&source); err != nil {
+		return err
+	}
+	*ns = NTPSources{source}
+	return nil
+}
+
+// NTPMakeStep sets when chronyd steps the clock instead of slewing it:
+// when the offset is larger than Threshold seconds, in the first Limit
+// updates
+type NTPMakeStep struct {
+	Threshold float64 `yaml:"threshold"`
+	Limit     int     `yaml:"limit"`
 }
 
 // MTAConfiguration contains all information for setting up a
 // mail transfer agent (mail forwarding)
 type MTAConfiguration struct {
-	Root             string `yaml:"root"`
-	Server           string `yaml:"server"`
-	UseTLS           bool   `yaml:"use_tls"`
-	UseSTARTTLS      bool   `yaml:"use_starttls"`
-	User             string `yaml:"user"`
-	Password         string `yaml:"password"`
-	AuthMethod       string `yaml:"authmethod"`
-	RewriteDomain    string `yaml:"rewrite_domain"`
-	FromLineOverride bool   `yaml:"fromline_override"`
+	Root             string                 `yaml:"root"`
+	Server           string                 `yaml:"server"`
+	UseTLS           bool                   `yaml:"use_tls"`
+	UseSTARTTLS      bool                   `yaml:"use_starttls"`
+	User             string                 `yaml:"user"`
+	Password         string                 `yaml:"password"`
+	AuthMethod       string                 `yaml:"authmethod"`
+	RewriteDomain    string                 `yaml:"rewrite_domain"`
+	FromLineOverride bool                   `yaml:"fromline_override"`
+	Type             string                 `yaml:"type"`
+	Aliases          map[string]MultiString `yaml:"aliases"`
+	TestRecipient    string                 `yaml:"test_recipient"`
 }
 
 // PackagesConfig contains specification for the `packages:` block.
 type PackagesConfig struct {
-	Repositories MultiString `yaml:"repositories"`
-	Update       bool        `yaml:"update"`
-	Upgrade      bool        `yaml:"upgrade"`
-	Install      MultiString `yaml:"install"`
-	Uninstall    MultiString `yaml:"uninstall"`
+	Repositories      MultiString `yaml:"repositories"`
+	Mirror            string      `yaml:"mirror"`
+	Mirrors           MultiString `yaml:"mirrors"`
+	Update            bool        `yaml:"update"`
+	Upgrade           bool        `yaml:"upgrade"`
+	Install           MultiString `yaml:"install"`
+	Uninstall         MultiString `yaml:"uninstall"`
+	Keys              []APKKey    `yaml:"keys"`
+	LocalRepositories MultiString `yaml:"local_repository"`
+	Cache             *APKCache   `yaml:"cache"`
+}
+
+// APKCache enables the apk package cache in Directory, which is seeded
+// with the packages found in the Seed directories.
+type APKCache struct {
+	Directory string      `yaml:"directory"`
+	Seed      MultiString `yaml:"seed"`
+}
+
+// APKKey is a repository signing (public) key, either given inline
+// or downloaded from a URL. Name defaults to the last element of the URL.
+type APKKey struct {
+	Name    string `yaml:"name"`
+	Content string `yaml:"content"`
+	URL     string `yaml:"url"`
+}
+
+// UnmarshalYAML allows an APKKey to be specified as just a URL
+func (k *APKKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*k = APKKey{URL: url}
+		return nil
+	}
+	type plain APKKey
+	return unmarshal((*plain)(k))
 }
 
 // WriteFile allows for specifying files and their content
 // that should be created on first boot.
 type WriteFile struct {
-	Encoding    string `yaml:"encoding"`
-	Content     string `yaml:"content"`
-	ContentURL  string `yaml:"content-url"`
-	Path        string `yaml:"path"`
-	Owner       string `yaml:"owner"`
-	Permissions string `yaml:"permissions"`
+	Encoding       string `yaml:"encoding"`
+	Content        string `yaml:"content"`
+	ContentURL     string `yaml:"content-url"`
+	Path           string `yaml:"path"`
+	Owner          string `yaml:"owner"`
+	Permissions    string `yaml:"permissions"`
+	Append         bool   `yaml:"append"`
+	Defer          bool   `yaml:"defer"`
+	Template       bool   `yaml:"template"`
+	Backup         bool   `yaml:"backup"`
+	DirPermissions string `yaml:"dir_permissions"`
+	DirOwner       string `yaml:"dir_owner"`
+}
+
+// GrowPartConfig specifies the `growpart:` block. When set, the root partition
+// is extended to the end of its disk and the root filesystem is resized.
+type GrowPartConfig struct {
+	DryRun bool `yaml:"dry_run"`
+}
+
+// ScratchDiskConfig specifies the `scratch_disk:` block. The device is set up
+// by setup-disk in data mode, which places /var on it.
+type ScratchDiskConfig struct {
+	Device         string      `yaml:"device"`
+	FileSystemType string      `yaml:"filesystem"`
+	MkfsOptions    string      `yaml:"mkfs_options"`
+	Directories    MultiString `yaml:"directories"`
+	StopServices   MultiString `yaml:"stop_services"`
+	Timeout        int         `yaml:"timeout"`
+}
+
+// UnmarshalYAML allows `scratch_disk:` to be either just a device name
+// or a full block. Defaults are applied for both forms.
+func (sd *ScratchDiskConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ScratchDiskConfig
+	cfg := plain{
+		FileSystemType: "xfs",
+		StopServices:   []string{"docker"},
+	}
+	var device string
+	if err := unmarshal(&device); err == nil {
+		cfg.Device = device
+	} else if err := unmarshal(&cfg); err != nil {
+		return err
+	}
+	*sd = ScratchDiskConfig(cfg)
+	return nil
+}
+
+// Service specifies the desired state of an OpenRC service. Enable and Disable
+// list runlevels, Action is one of start, stop, restart or reload, and Options
+// are set in /etc/conf.d/<name>.
+type Service struct {
+	Name    string            `yaml:"name"`
+	Enable  MultiString       `yaml:"enable"`
+	Disable MultiString       `yaml:"disable"`
+	Action  string            `yaml:"action"`
+	Options map[string]string `yaml:"options"`
+}
+
+// ConfigFile specifies an edit of a key/value style configuration file.
+// Format is one of shell, equals, space or colon.
+type ConfigFile struct {
+	Path     string            `yaml:"path"`
+	Format   string            `yaml:"format"`
+	Settings map[string]string `yaml:"settings"`
+	Remove   MultiString       `yaml:"remove"`
+}
+
+// LBUConfig specifies the `lbu:` block, for committing lift's changes to the
+// local backup in diskless mode. Enabled defaults to detecting diskless mode.
+type LBUConfig struct {
+	Enabled *bool       `yaml:"enabled"`
+	Media   string      `yaml:"media"`
+	Include MultiString `yaml:"include"`
+}
+
+// InstallConfig specifies the `install:` block, for installing Alpine to
+// Disk with setup-alpine. Mode is the setup-disk mode: sys (default) or data.
+type InstallConfig struct {
+	Disk   string `yaml:"disk"`
+	Mode   string `yaml:"mode"`
+	Reboot bool   `yaml:"reboot"`
+}
+
+// ScriptsConfig specifies the `scripts:` block, with the scripts (name and
+// content) to put in each of the script directories
+type ScriptsConfig struct {
+	PerBoot     map[string]string `yaml:"per-boot"`
+	PerInstance map[string]string `yaml:"per-instance"`
+	PerOnce     map[string]string `yaml:"per-once"`
+}
+
+// Command is a runcmd entry: either just a command line, or a map with
+// the command line in `cmd` and options for executing it. Timeout is in
+// seconds, and Retries is the number of extra attempts after a failure.
+type Command struct {
+	Cmd          CommandLine       `yaml:"cmd"`
+	User         string            `yaml:"user"`
+	Cwd          string            `yaml:"cwd"`
+	Env          map[string]string `yaml:"env"`
+	Timeout      int               `yaml:"timeout"`
+	Retries      int               `yaml:"retries"`
+	IgnoreErrors bool              `yaml:"ignore_errors"`
+}
+
+// UnmarshalYAML allows a Command to be given as just its command line
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var cl CommandLine
+	if err := unmarshal(&cl); err == nil {
+		*c = Command{Cmd: cl}
+		return nil
+	}
+	type plain Command
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Cmd.Args) == 0 {
+		return errors.New("command without cmd")
+	}
+	return nil
+}
+
+// CommandLine is either a string, which is executed through `sh -c`,
+// or an argv list, which is executed without a shell.
+type CommandLine struct {
+	Args  []string
+	Shell bool
+}
+
+// UnmarshalYAML parses a command line from a string or a list of strings
+func (cl *CommandLine) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*cl = CommandLine{Args: []string{s}, Shell: true}
+		return nil
+	}
+	var argv []string
+	if err := unmarshal(&argv); err != nil {
+		return err
+	}
+	*cl = CommandLine{Args: argv}
+	return nil
 }
 
 // Disk specifies a disk that should be formatted and mounted
@@ -164,12 +475,6 @@ func InitAlpineData() *AlpineData {
 		DRP: &DRProvision{
 			InstallRunner: true,
 		},
-		Packages: &PackagesConfig{
-			Repositories: []string{
-				"http://dl-cdn.alpinelinux.org/alpine/v3.8/main",
-				"http://dl-cdn.alpinelinux.org/alpine/v3.8/community",
-			},
-		},
 	}
 }
 
@@ -0,0 +1,196 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/kvfile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dnsUnbound = "unbound"
+	dnsDnsmasq = "dnsmasq"
+
+	resolvConfFile  = "/etc/resolv.conf"
+	udhcpcConfFile  = "/etc/udhcpc/udhcpc.conf"
+	unboundConfFile = "/etc/unbound/unbound.conf"
+	dnsmasqConfFile = "/etc/dnsmasq.conf"
+	dnsmasqConfDir  = "/etc/dnsmasq.d"
+
+	// number of nameservers the musl resolver uses
+	muslMaxNameservers = 3
+)
+
+// writes resolv.conf with the nameservers, search domains and options of
+// the `resolv_conf:` block. With a caching resolver, resolv.conf points to
+// localhost and the nameservers are used as its forwarders.
+func (l *Lift) dnsSetup() error {
+	rc := l.Data.Network.ResolvConf
+	if rc == nil {
+		log.Debug("No resolv.conf configured")
+		return nil
+	}
+
+	nameservers := []string(rc.NameServers)
+	for _, ns := range nameservers {
+		if !validNameserver(ns) {
+			return fmt.Errorf("resolv_conf: invalid nameserver %s", ns)
+		}
+	}
+	if len(nameservers) == 0 {
+		if rc.Cache != "" {
+			return fmt.Errorf("resolv_conf: %s needs nameservers to forward to", rc.Cache)
+		}
+		// keep the nameservers that are there, e.g. from DHCP
+		nameservers = currentNameservers()
+	}
+
+	if rc.Cache != "" {
+		if err := l.cachingResolverSetup(rc.Cache, nameservers); err != nil {
+			return err
+		}
+		nameservers = []string{"127.0.0.1", "::1"}
+	}
+
+	// musl only queries the first nameservers and ignores rotate
+	if len(nameservers) > muslMaxNameservers {
+		log.Warnf("resolv_conf: only the first %d of %d nameservers are used", muslMaxNameservers, len(nameservers))
+	}
+	if rc.Options != nil && rc.Options.Rotate {
+		log.Warn("resolv_conf: option rotate is ignored by musl")
+	}
+
+	log.Debugf("Writing %s", resolvConfFile)
+	if err := writeFileAtomic(resolvConfFile, renderResolvConf(rc, nameservers), 0644, -1, -1); err != nil {
+		return err
+	}
+	l.persist(resolvConfFile)
+
+	if rc.Protect == nil || *rc.Protect {
+		return protectResolvConf()
+	}
+	return nil
+}
+
+// checks that a nameserver is an IPv4 or IPv6 address, optionally with a zone
+func validNameserver(ns string) bool {
+	if i := strings.Index(ns, "%"); i > 0 {
+		ns = ns[:i]
+	}
+	return net.ParseIP(ns) != nil
+}
+
+// returns the nameservers in the current resolv.conf
+func currentNameservers() []string {
+	b, err := ioutil.ReadFile(resolvConfFile)
+	if err != nil {
+		return nil
+	}
+	var nameservers []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+	return nameservers
+}
+
+// renders resolv.conf
+func renderResolvConf(rc *ResolvConfiguration, nameservers []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Generated by lift\n")
+
+	var search []string
+	seen := make(map[string]bool)
+	for _, d := range append([]string{rc.Domain}, rc.SearchDomains...) {
+		if d != "" && !seen[d] {
+			seen[d] = true
+			search = append(search, d)
+		}
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	for _, ns := range nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+
+	if o := rc.Options; o != nil {
+		var opts []string
+		if o.NDots != nil {
+			opts = append(opts, fmt.Sprintf("ndots:%d", *o.NDots))
+		}
+		if o.Timeout != nil {
+			opts = append(opts, fmt.Sprintf("timeout:%d", *o.Timeout))
+		}
+		if o.Attempts != nil {
+			opts = append(opts, fmt.Sprintf("attempts:%d", *o.Attempts))
+		}
+		if o.Rotate {
+			opts = append(opts, "rotate")
+		}
+		if len(opts) > 0 {
+			fmt.Fprintf(&b, "options %s\n", strings.Join(opts, " "))
+		}
+	}
+	return b.Bytes()
+}
+
+// installs and configures a local caching resolver forwarding to the nameservers
+func (l *Lift) cachingResolverSetup(cache string, forwarders []string) error {
+	var (
+		t    *template.Template
+		path string
+	)
+	switch cache {
+	case dnsUnbound:
+		t, path = unboundConf, unboundConfFile
+	case dnsDnsmasq:
+		t, path = dnsmasqConf, dnsmasqConfFile
+		if err := os.MkdirAll(dnsmasqConfDir, 0755); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("resolv_conf: unsupported cache %s", cache)
+	}
+
+	if err := l.apkAdd(cache); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, forwarders); err != nil {
+		return err
+	}
+	log.Debugf("Writing %s", path)
+	if err := writeFileAtomic(path, b.Bytes(), 0644, -1, -1); err != nil {
+		return err
+	}
+	l.persist(path)
+
+	if err := enableService(cache, defaultRunlevel); err != nil {
+		return err
+	}
+	return doService(cache, RESTART)
+}
+
+// keeps udhcpc from overwriting resolv.conf with the nameservers from DHCP
+func protectResolvConf() error {
+	f, err := kvfile.Load(udhcpcConfFile, kvfile.Shell)
+	if err != nil {
+		return err
+	}
+	f.Set("RESOLV_CONF", "no")
+	if !f.Changed() {
+		return nil
+	}
+	log.Debugf("Writing %s", udhcpcConfFile)
+	return f.Save()
+}
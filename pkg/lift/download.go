@@ -1,12 +1,18 @@
 package lift
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
-// DownloadFile returns a file from http(s)
+// DownloadFile returns a file from http(s), or a local file from a file:// url
 func downloadFile(url string, headers http.Header) ([]byte, error) {
+	if strings.HasPrefix(url, "file://") {
+		return ioutil.ReadFile(strings.TrimPrefix(url, "file://"))
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -17,9 +23,23 @@ func downloadFile(url string, headers http.Header) ([]byte, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
+
+// checks whether a url responds successfully to a HEAD request within the timeout
+func urlReachable(url string, timeout time.Duration) bool {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Head(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode <= 299
+}
@@ -1,6 +1,9 @@
 package lift
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,20 +11,26 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/mitchellh/go-ps"
 	"github.com/moby/sys/mountinfo"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	drpcliBin      = "/usr/local/bin/drpcli"
-	drpcliRCFile   = "/etc/init.d/drpcli"
-	chronyConfFile = "/etc/chrony/chrony.conf"
-	ssmtpConfFile  = "/etc/ssmtp/ssmtp.conf"
+	drpcliBin     = "/usr/local/bin/drpcli"
+	drpcliRCFile  = "/etc/init.d/drpcli"
+	ssmtpConfFile = "/etc/ssmtp/ssmtp.conf"
+
+	// directories relocated onto the scratch disk are kept here
+	scratchRelocateDir = "/var/lib/lift/scratch"
+	// network interfaces when not specified in alpine-data
+	defaultInterfaces         = "auto lo\niface lo inet loopback\n\nauto eth0\niface eth0 inet dhcp\n"
+	defaultInterfacesHostname = defaultInterfaces + "    hostname %s\n"
+	// default upper bound for waiting on services to stop or start
+	defaultServiceTimeout = 30 * time.Second
 )
 
 var (
@@ -63,82 +72,58 @@ func (l *Lift) setHostname() error {
 	return nil
 }
 
-// mtaSetup installs and configures ssmtp as MTA
-func (l *Lift) mtaSetup() error {
-	if l.Data.MTA == nil {
-		log.Debug("No MTA configured")
+// executes the setup-disk script if scratch disk is set
+// Running services (e.g. Docker) that keep files open below the
+// relocated directories are stopped first, since they prevent the
+// scratch disk from being mounted correctly.
+func (l *Lift) scratchDiskSetup() error {
+	sd := l.Data.ScratchDisk
+	if sd == nil || sd.Device == "" {
+		log.Debug("No Scratch Disk defined")
 		return nil
 	}
-
-	log.Debug("apk add ssmtp")
-	cmd := exec.Command("apk", "add", "ssmtp")
-	if err := cmd.Run(); err != nil {
-		return err
+	fsType := strings.ToLower(sd.FileSystemType)
+	if fsType == "" {
+		fsType = "xfs"
 	}
-
-	log.Debug("Generating ssmtp.conf")
-	ssmtp, err := generateFileFromTemplate(*ssmtpConf, l.Data)
-	if err != nil {
-		return err
+	if _, ok := fsPackage[fsType]; !ok {
+		return fmt.Errorf("scratch_disk: unsupported filesystem %s", sd.FileSystemType)
 	}
-
-	log.Debugf("Copying ssmtp.conf to %s", ssmtpConfFile)
-	cmd = exec.Command("mv", ssmtp, ssmtpConfFile)
-	if err := cmd.Run(); err != nil {
-		return err
+	timeout := time.Duration(sd.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultServiceTimeout
 	}
 
-	return nil
-}
-
-// executes the setup-disk script if scratch disk is set
-// It tries to detect if Docker is running, since Docker will
-// mount /var/lib/docker, which prevents the scratch disk
-// from being mounted correctly.
-func (l *Lift) scratchDiskSetup() error {
-	if l.Data.ScratchDisk == "" {
-		log.Debug("No Scratch Disk defined")
-		return nil
+	var stopped []string
+	for _, svc := range sd.StopServices {
+		if !serviceStarted(svc) {
+			log.WithField("service", svc).Debug("Service not started")
+			continue
+		}
+		log.Infof("Stopping %s...", svc)
+		if err := doService(svc, STOP); err != nil {
+			return fmt.Errorf("stopping %s: %v", svc, err)
+		}
+		if err := waitForService(svc, false, timeout); err != nil {
+			return err
+		}
+		stopped = append(stopped, svc)
 	}
 
-	log.Debug("Check if Docker is running")
-	// Give Docker some time to start
-	time.Sleep(3 * time.Second)
-	dockerPresent := false
-	procs, err := ps.Processes()
-	if err != nil {
+	if err := unmountBelow(sd.Directories); err != nil {
 		return err
 	}
-	log.WithField("numprocs", len(procs)).Debug("Fetch process list")
-	for _, p := range procs {
-		log.Debugf("Process: %s", p.Executable())
-		if strings.Contains(strings.ToLower(p.Executable()), "docker") {
-			log.Debug("Docker process detected")
-			dockerPresent = true
-		}
-	}
 
-	if dockerPresent {
-		log.Info("Stopping Docker...")
-		_ = doService("docker", STOP)
-		// Wait a little bit for Docker to stop
-		time.Sleep(2 * time.Second)
+	mkfsOpts := sd.MkfsOptions
+	if mkfsOpts == "" && fsType == "xfs" {
+		mkfsOpts = "-f"
 	}
-
-	mnts, _ := mountinfo.GetMounts(func(mnt *mountinfo.Info) (skip, stop bool) {
-		if strings.Contains(mnt.Mountpoint, "/var") {
-			return false, false
-		}
-		return true, false
-	})
-	for _, mnt := range mnts {
-		log.Infof("Unmounting %s", mnt.Mountpoint)
-		cmd := exec.Command("umount", mnt.Mountpoint)
-		_ = cmd.Run()
+	if err := l.apkAdd(fsPackage[fsType]); err != nil {
+		return err
 	}
 
-	log.WithField("disk", l.Data.ScratchDisk).Debug("Setup Scratch Disk")
-	cmd := exec.Command("setup-disk", "-q", "-m", "data", l.Data.ScratchDisk)
+	log.WithField("disk", sd.Device).Debug("Setup Scratch Disk")
+	cmd := exec.Command("setup-disk", "-q", "-m", "data", sd.Device)
 
 	// If not silenced, show setup-alpine output on stdout
 	if !silent {
@@ -146,9 +131,9 @@ func (l *Lift) scratchDiskSetup() error {
 		cmd.Stderr = os.Stderr
 	}
 
-	env := append(os.Environ(), "VARFS=xfs")
-	env = append(env, fmt.Sprintf("ERASE_DISKS=%s", l.Data.ScratchDisk))
-	env = append(env, "MKFS_OPTS_VAR=-f")
+	env := append(os.Environ(), fmt.Sprintf("VARFS=%s", fsType))
+	env = append(env, fmt.Sprintf("ERASE_DISKS=%s", sd.Device))
+	env = append(env, fmt.Sprintf("MKFS_OPTS_VAR=%s", mkfsOpts))
 	env = append(env, "DEFAULT_DISK=none")
 	cmd.Env = env
 
@@ -156,17 +141,33 @@ func (l *Lift) scratchDiskSetup() error {
 		return err
 	}
 
-	if dockerPresent {
-		log.Info("Starting Docker...")
-		_ = doService("docker", START)
+	// setup-disk only relocates /var, so move any other directories
+	// onto the scratch disk and bind mount them back in place
+	for _, dir := range sd.Directories {
+		if filepath.Clean(dir) == "/var" {
+			continue
+		}
+		if err := relocateDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	for _, svc := range stopped {
+		log.Infof("Starting %s...", svc)
+		if err := doService(svc, START); err != nil {
+			return fmt.Errorf("starting %s: %v", svc, err)
+		}
+		if err := waitForService(svc, true, timeout); err != nil {
+			return err
+		}
 	}
 
 	// Check if swap was re-enabled
-	out, err := exec.Command("cat", "/proc/swap").Output()
+	out, err := ioutil.ReadFile("/proc/swaps")
 	if err != nil {
 		return nil
 	}
-	if !strings.Contains(string(out), l.Data.ScratchDisk) {
+	if !strings.Contains(string(out), sd.Device) {
 		// just try, don't care about the result since we can't fix it here..
 		_ = exec.Command("swapon", "-a").Run()
 	}
@@ -174,6 +175,88 @@ func (l *Lift) scratchDiskSetup() error {
 	return nil
 }
 
+// unmounts everything mounted at or below /var and the given directories,
+// deepest mountpoint first, and verifies nothing is left mounted
+func unmountBelow(dirs []string) error {
+	prefixes := []string{"/var"}
+	for _, d := range dirs {
+		prefixes = append(prefixes, filepath.Clean(d))
+	}
+	mnts, err := mountinfo.GetMounts(func(mnt *mountinfo.Info) (skip, stop bool) {
+		for _, p := range prefixes {
+			if mnt.Mountpoint == p || strings.HasPrefix(mnt.Mountpoint, p+"/") {
+				return false, false
+			}
+		}
+		return true, false
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(mnts, func(i, j int) bool {
+		return len(mnts[i].Mountpoint) > len(mnts[j].Mountpoint)
+	})
+	for _, mnt := range mnts {
+		log.Infof("Unmounting %s", mnt.Mountpoint)
+		_ = exec.Command("umount", mnt.Mountpoint).Run()
+		mounted, err := mountinfo.Mounted(mnt.Mountpoint)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			return fmt.Errorf("unable to unmount %s", mnt.Mountpoint)
+		}
+	}
+	return nil
+}
+
+// moves a directory onto the scratch disk (mounted on /var by setup-disk)
+// and bind mounts it back onto its original location
+func relocateDirectory(dir string) error {
+	dir = filepath.Clean(dir)
+	target := filepath.Join(scratchRelocateDir, dir)
+	log.Infof("Relocating %s to %s", dir, target)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if out, err := exec.Command("cp", "-a", dir+"/.", target).CombinedOutput(); err != nil {
+		return fmt.Errorf("copying %s: %v: %s", dir, err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("mount", "--bind", target, dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("bind mounting %s: %v: %s", dir, err, strings.TrimSpace(string(out)))
+	}
+	if fstabHasMount(target, dir) {
+		log.Debugf("Bind mount of %s already in /etc/fstab", dir)
+		return nil
+	}
+	file, err := openOrCreate("/etc/fstab")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(fmt.Sprintf("%s\t%s\tnone\tbind\t0 0\n", target, dir))
+	return err
+}
+
+// checks if /etc/fstab already mounts source on mountpoint
+func fstabHasMount(source, mountpoint string) bool {
+	b, err := ioutil.ReadFile("/etc/fstab")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") &&
+			filepath.Clean(fields[0]) == source && filepath.Clean(fields[1]) == mountpoint {
+			return true
+		}
+	}
+	return false
+}
+
 // Encrypt, Format and mount other disks if configured
 func (l *Lift) diskSetup() error {
 	if l.Data.Disks == nil {
@@ -182,7 +265,9 @@ func (l *Lift) diskSetup() error {
 	}
 	for i, disk := range l.Data.Disks {
 		log.Debug("Installing cryptsetup package")
-		_ = exec.Command("apk", "add", "--no-cache", "cryptsetup").Run()
+		if err := l.apkAdd("cryptsetup"); err != nil {
+			return err
+		}
 		log.Debug("Generating random key")
 		rand.Seed(time.Now().UnixNano())
 		letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -214,9 +299,11 @@ func (l *Lift) diskSetup() error {
 			return err
 		}
 
-		// Check filesystem support and kernel modules. Ignore exit codes..
+		// Check filesystem support and kernel modules
 		log.Debugf("Checking filesystem prerequisites")
-		_ = exec.Command("apk", "add", "--no-cache", fsPackage[strings.ToLower(disk.FileSystemType)]).Run()
+		if err := l.apkAdd(fsPackage[strings.ToLower(disk.FileSystemType)]); err != nil {
+			return err
+		}
 		_ = exec.Command("modprobe", strings.ToLower(disk.FileSystemType)).Run()
 
 		mapdevice := fmt.Sprintf("/dev/mapper/%s", mapper)
@@ -269,20 +356,11 @@ func (l *Lift) networkSetup() error {
 	return nil
 }
 
-// sets the proxy
-func (l *Lift) proxySetup() error {
-	if l.Data.Network.Proxy != "" {
-		log.WithField("proxy", l.Data.Network.Proxy).Debug("Found proxy setting")
-		cmd := exec.Command("setup-proxy", l.Data.Network.Proxy)
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 // sets root password if needed
 func (l *Lift) rootPasswdSetup() error {
+	if l.Data.RootHashedPasswd != "" {
+		return setPassword("root", l.Data.RootHashedPasswd, true)
+	}
 	// Always set a password, randomized if empty..
 	if l.Data.RootPasswd == "" {
 		rand.Seed(time.Now().UnixNano())
@@ -292,24 +370,10 @@ func (l *Lift) rootPasswdSetup() error {
 			b[i] = letterRunes[rand.Intn(len(letterRunes))]
 		}
 		l.Data.RootPasswd = string(b)
+	} else {
+		log.Warn("Cleartext root password in alpine-data; consider using hashed_password")
 	}
-	chpasswdCmd := exec.Command("chpasswd")
-	reader, writer := io.Pipe()
-	s := []byte(fmt.Sprintf("root:%s\n", l.Data.RootPasswd))
-
-	chpasswdCmd.Stdout = os.Stdout
-	chpasswdCmd.Stderr = os.Stderr
-	chpasswdCmd.Stdin = reader
-	chpasswdCmd.Start()
-	writer.Write(s)
-	writer.Close()
-	err := chpasswdCmd.Wait()
-	reader.Close()
-	if err != nil {
-		return err
-	}
-	return nil
-
+	return setPassword("root", l.Data.RootPasswd, false)
 }
 
 // parses sshd_config, writes authorized_keys file and restarts sshd service
@@ -317,7 +381,15 @@ func (l *Lift) sshdSetup() error {
 	if l.Data.SSHDConfig == nil {
 		return nil
 	}
-	if err := parseConfigFile("/etc/ssh/sshd_config", " ", l.getSSHDKVMap()); err != nil {
+	// host keys go first, since sshd -t fails validating the
+	// configuration when no (configured) host key is available
+	if err := l.sshdHostKeysSetup(); err != nil {
+		return err
+	}
+	if out, err := exec.Command("ssh-keygen", "-A").CombinedOutput(); err != nil {
+		return fmt.Errorf("generating missing host keys: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := l.sshdConfigSetup(); err != nil {
 		return err
 	}
 	if err := l.addSSHKeys(); err != nil {
@@ -326,58 +398,22 @@ func (l *Lift) sshdSetup() error {
 	if err := doService("sshd", RESTART); err != nil {
 		return err
 	}
-	return nil
-}
-
-// call setup-dns Alpine setup script for configuring resolv.conf
-func (l *Lift) dnsSetup() error {
-	if l.Data.Network.ResolvConf != nil {
-		if l.Data.Network.ResolvConf.NameServers != nil && len(l.Data.Network.ResolvConf.NameServers) > 0 {
-			cmd := exec.Command("setup-dns", "-d", l.Data.Network.ResolvConf.Domain, "-n", strings.Join(l.Data.Network.ResolvConf.NameServers, " "))
-			if err := cmd.Run(); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-// call setup-ntp Alpine setup script for configuring NTP
-func (l *Lift) ntpSetup() error {
-	if l.Data.Network.NTP != nil {
-		if (l.Data.Network.NTP.Pools != nil && len(l.Data.Network.NTP.Pools) > 0) ||
-			(l.Data.Network.NTP.Servers != nil && len(l.Data.Network.NTP.Servers) > 0) {
-			cmd := exec.Command("setup-ntp", "-c", "chrony")
-			if err := cmd.Run(); err != nil {
-				return err
-			}
-			log.Debug("Generating chrony.conf")
-			chrony, err := generateFileFromTemplate(*chronyConf, l.Data)
-			if err != nil {
-				return err
-			}
-			log.Debugf("Copying chrony.conf to %s", chronyConfFile)
-			cmd = exec.Command("mv", chrony, chronyConfFile)
-			if err := cmd.Run(); err != nil {
-				return err
-			}
-			log.Debug("Restart Chrony")
-			_ = doService("chronyd", RESTART)
-		}
-	}
+	l.publishHostKeyFingerprints()
 	return nil
 }
 
 // opens or creates authorized_keys file, and adds ssh keys
-// from alpine-data
+// from alpine-data, including those imported from key sources
 func (l *Lift) addSSHKeys() error {
-	if l.Data.SSHDConfig.AuthorizedKeys != nil && len(l.Data.SSHDConfig.AuthorizedKeys) > 0 {
+	keys := append(l.Data.SSHDConfig.AuthorizedKeys, l.importSSHKeys(l.Data.SSHDConfig.SSHImportID)...)
+	if len(keys) > 0 {
 		file, err := openOrCreate("/root/.ssh/authorized_keys")
 		if err != nil {
 			return err
 		}
+		l.persist("/root/.ssh")
 		defer file.Close()
-		for _, key := range l.Data.SSHDConfig.AuthorizedKeys {
+		for _, key := range keys {
 			if _, err = file.WriteString(fmt.Sprintf("%s\n", key)); err != nil {
 				return err
 			}
@@ -401,6 +437,7 @@ func (l *Lift) drpSetup() error {
 		if err != nil {
 			return err
 		}
+		l.persist(drpcliBin)
 	}
 
 	// then check RC file
@@ -423,9 +460,7 @@ func (l *Lift) drpSetup() error {
 			return err
 		}
 		log.Debug("Add drpcli service to default runlevel")
-		cmd = exec.Command("rc-update", "add", "drpcli")
-		err = cmd.Run()
-		if err != nil {
+		if err = enableService("drpcli", defaultRunlevel); err != nil {
 			return err
 		}
 	}
@@ -435,105 +470,137 @@ func (l *Lift) drpSetup() error {
 	return nil
 }
 
-func (l *Lift) setupAPK() error {
-	if l.Data.Packages == nil {
-		return nil
-	}
-	rfile, err := generateFileFromTemplate(*repoFile, l.Data.Packages.Repositories)
-	if err != nil {
-		return err
-	}
-	log.Debug("Setting up repositories")
-	cmd := exec.Command("mv", rfile, "/etc/apk/repositories")
-	err = cmd.Run()
-	if err != nil {
-		return err
-	}
-	if l.Data.Packages.Update {
-		log.Debug("Executing apk update")
-		cmd := exec.Command("apk", "update")
-		err = cmd.Run()
+func (l *Lift) setMOTD() error {
+	if l.Data.MOTD != "" {
+		err := os.Truncate("/etc/motd", 0)
 		if err != nil {
 			return err
 		}
-	}
-	if l.Data.Packages.Upgrade {
-		log.Debug("Executing apk upgrade")
-		cmd := exec.Command("apk", "upgrade")
-		err = cmd.Run()
+		file, err := os.OpenFile("/etc/motd", os.O_RDWR|os.O_EXCL, 0600)
 		if err != nil {
 			return err
 		}
-	}
-	for _, p := range l.Data.Packages.Uninstall {
-		log.WithField("package", p).Debug("Executing apk del")
-		cmd := exec.Command("apk", "del", p)
-		err = cmd.Run()
-		if err != nil {
+		defer file.Close()
+		if _, err = file.WriteString(fmt.Sprintf("%s\n", l.Data.MOTD)); err != nil {
 			return err
 		}
 	}
-	for _, p := range l.Data.Packages.Install {
-		log.WithField("package", p).Debug("Executing apk add")
-		cmd := exec.Command("apk", "add", p)
-		err = cmd.Run()
-		if err != nil {
-			return err
+	return nil
+}
+
+// writes the write_files entries; either the deferred ones, which are
+// written after packages, users and services are set up, or the others
+func (l *Lift) createFiles(deferred bool) error {
+	for _, wf := range l.Data.WriteFiles {
+		if wf.Defer != deferred {
+			continue
+		}
+		log.Infof("Creating %s", wf.Path)
+		if err := l.writeFile(wf); err != nil {
+			return fmt.Errorf("Error writing %s: %s", wf.Path, err)
 		}
 	}
 	return nil
 }
 
-func (l *Lift) setMOTD() error {
-	if l.Data.MOTD != "" {
-		err := os.Truncate("/etc/motd", 0)
-		if err != nil {
+// writes a single write_files entry atomically, with its owner resolved
+// from /etc/passwd and /etc/group
+func (l *Lift) writeFile(wf WriteFile) error {
+	var data []byte
+
+	// without permissions, an existing file keeps its mode
+	def := os.FileMode(defaultFileMode)
+	if fi, err := os.Stat(wf.Path); err == nil {
+		def = fi.Mode().Perm()
+	}
+	perm, err := parsePermissions(wf.Permissions, def)
+	if err != nil {
+		return fmt.Errorf("reading permissions: %s", err)
+	}
+	dirMode, err := parsePermissions(wf.DirPermissions, defaultDirMode)
+	if err != nil {
+		return fmt.Errorf("reading directory permissions: %s", err)
+	}
+	uid, gid := -1, -1
+	if wf.Owner != "" {
+		if uid, gid, err = lookupOwner(wf.Owner); err != nil {
 			return err
 		}
-		file, err := os.OpenFile("/etc/motd", os.O_RDWR|os.O_EXCL, 0600)
-		if err != nil {
+	}
+	dirUID, dirGID := -1, -1
+	if wf.DirOwner != "" {
+		if dirUID, dirGID, err = lookupOwner(wf.DirOwner); err != nil {
 			return err
 		}
-		defer file.Close()
-		if _, err = file.WriteString(fmt.Sprintf("%s\n", l.Data.MOTD)); err != nil {
+	}
+
+	if wf.Content != "" {
+		data = []byte(wf.Content)
+	} else if wf.ContentURL != "" {
+		if data, err = downloadFile(wf.ContentURL, nil); err != nil {
 			return err
 		}
 	}
-	return nil
-}
-
-func (l *Lift) createFiles() error {
-	for _, wf := range l.Data.WriteFiles {
-		var data []byte
+	if data, err = decodeContent(data, wf.Encoding); err != nil {
+		return fmt.Errorf("decoding: %s", err)
+	}
+	if wf.Template {
+		if data, err = l.renderContent(wf.Path, data); err != nil {
+			return fmt.Errorf("rendering: %s", err)
+		}
+	}
 
-		perm, err := strconv.ParseUint(wf.Permissions, 8, 32)
-		if err != nil {
-			return fmt.Errorf("Error reading permissions: %s", err)
+	if err = mkdirAllOwned(filepath.Dir(wf.Path), dirMode, dirUID, dirGID); err != nil {
+		return err
+	}
+	if wf.Backup {
+		if err = backupFile(wf.Path); err != nil {
+			return err
 		}
-		log.Infof("Creating %s", wf.Path)
-		err = os.MkdirAll(filepath.Dir(wf.Path), 0711)
-		if err != nil {
-			return fmt.Errorf("Error creating %s: %s", filepath.Dir(wf.Path), err)
+	}
+	if wf.Append {
+		current, err := ioutil.ReadFile(wf.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
-		if wf.Content != "" {
-			data = []byte(wf.Content)
+		data = append(current, data...)
+	}
+	l.persist(wf.Path)
+	return writeFileAtomic(wf.Path, data, perm, uid, gid)
+}
 
-		} else if wf.ContentURL != "" {
-			if data, err = downloadFile(wf.ContentURL, nil); err != nil {
-				return err
-			}
-		}
-		err = ioutil.WriteFile(wf.Path, data, os.FileMode(perm))
+// decodes write_files content according to its encoding:
+// text (default), b64, gzip or gz+b64
+func decodeContent(data []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "text", "text/plain":
+		return data, nil
+	case "b64", "base64":
+		return decodeBase64(data)
+	case "gz", "gzip":
+		return gunzip(data)
+	case "gz+b64", "gzip+b64", "gz+base64", "gzip+base64":
+		raw, err := decodeBase64(data)
 		if err != nil {
-			log.Debugf("error writing file: %s", err)
-		}
-		if wf.Owner != "" {
-			cmd := exec.Command("chown", wf.Owner, wf.Path)
-			err = cmd.Run()
-			if err != nil {
-				return err
-			}
+			return nil, err
 		}
+		return gunzip(raw)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %s", encoding)
 	}
-	return nil
+}
+
+// decodes base64, ignoring any whitespace (e.g. line wrapping in yaml)
+func decodeBase64(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+}
+
+// decompresses gzip data
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
@@ -0,0 +1,62 @@
+package lift
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Facts are details of the instance lift runs on, available when
+// rendering templated content
+type Facts struct {
+	Hostname      string
+	FQDN          string
+	Arch          string
+	AlpineRelease string
+	KernelRelease string
+	IPAddresses   []string
+	BootParams    map[string]string
+}
+
+// gathers the instance facts once, and returns them
+func (l *Lift) getFacts() *Facts {
+	if l.facts != nil {
+		return l.facts
+	}
+	f := &Facts{
+		Arch:       runtime.GOARCH,
+		BootParams: make(map[string]string),
+	}
+	f.Hostname, _ = os.Hostname()
+	f.FQDN = f.Hostname
+	if l.Data.Network != nil && strings.Contains(l.Data.Network.HostName, ".") {
+		f.FQDN = l.Data.Network.HostName
+	}
+	if b, err := ioutil.ReadFile(alpineReleaseFile); err == nil {
+		f.AlpineRelease = strings.TrimSpace(string(b))
+	}
+	if b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		f.KernelRelease = strings.TrimSpace(string(b))
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				f.IPAddresses = append(f.IPAddresses, ipnet.IP.String())
+			}
+		}
+	}
+	if b, err := ioutil.ReadFile("/proc/cmdline"); err == nil {
+		for _, a := range strings.Fields(string(b)) {
+			kv := strings.SplitN(a, "=", 2)
+			if len(kv) == 2 {
+				f.BootParams[kv[0]] = kv[1]
+			} else {
+				f.BootParams[kv[0]] = ""
+			}
+		}
+	}
+	l.facts = f
+	return f
+}
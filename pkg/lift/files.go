@@ -0,0 +1,213 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/atomicfile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	passwdFile   = "/etc/passwd"
+	groupFile    = "/etc/group"
+	shadowFile   = "/etc/shadow"
+	backupSuffix = ".lift-bak"
+	// default mode of parent directories created for write_files
+	defaultDirMode = 0711
+	// default mode of write_files without permissions
+	defaultFileMode = 0644
+)
+
+// passwdEntry is a user from /etc/passwd
+type passwdEntry struct {
+	Name string
+	UID  int
+	GID  int
+	Home string
+}
+
+// looks up a user by name in /etc/passwd
+func lookupPasswd(name string) (*passwdEntry, error) {
+	data, err := ioutil.ReadFile(passwdFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 6 || fields[0] != name {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid for user %s", name)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid for user %s", name)
+		}
+		return &passwdEntry{Name: name, UID: uid, GID: gid, Home: fields[5]}, nil
+	}
+	return nil, fmt.Errorf("user %s not found", name)
+}
+
+// returns the password field of a user in /etc/shadow
+func shadowPassword(name string) (string, error) {
+	data, err := ioutil.ReadFile(shadowFile)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 2 && fields[0] == name {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("user %s not found", name)
+}
+
+// looks up a group id by name in /etc/group
+func lookupGroup(name string) (int, error) {
+	data, err := ioutil.ReadFile(groupFile)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid gid for group %s", name)
+		}
+		return gid, nil
+	}
+	return 0, fmt.Errorf("group %s not found", name)
+}
+
+// resolves an owner in chown format (user, user:group, user: or numeric ids)
+// to a uid and gid. A gid of -1 leaves the group unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, gid := -1, -1
+	primaryGID := -1
+	if parts[0] != "" {
+		if id, err := strconv.Atoi(parts[0]); err == nil {
+			uid = id
+		} else {
+			u, err := lookupPasswd(parts[0])
+			if err != nil {
+				return 0, 0, err
+			}
+			uid, primaryGID = u.UID, u.GID
+		}
+	}
+	if len(parts) == 2 {
+		switch {
+		case parts[1] == "":
+			// "user:" means the user's login group
+			if primaryGID < 0 {
+				return 0, 0, fmt.Errorf("invalid owner %s", owner)
+			}
+			gid = primaryGID
+		default:
+			if id, err := strconv.Atoi(parts[1]); err == nil {
+				gid = id
+			} else if gid, err = lookupGroup(parts[1]); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// creates the missing parent directories of path with the given mode,
+// and owner (uid/gid of -1 are left unchanged)
+func mkdirAllOwned(dir string, mode os.FileMode, uid, gid int) error {
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if err := mkdirAllOwned(filepath.Dir(dir), mode, uid, gid); err != nil {
+		return err
+	}
+	log.Debugf("Creating directory %s", dir)
+	if err := os.Mkdir(dir, mode); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// Mkdir is subject to the umask
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+	if uid >= 0 || gid >= 0 {
+		return os.Chown(dir, uid, gid)
+	}
+	return nil
+}
+
+// copies an existing file to <path>.lift-bak, keeping its mode and owner
+func backupFile(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bak := path + backupSuffix
+	log.Debugf("Backing up %s to %s", path, bak)
+	if err = writeFileAtomic(bak, data, fi.Mode().Perm(), -1, -1); err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(bak, int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
+
+// writes a file through a temporary file in the same directory, which is
+// given its mode and owner before being renamed into place. A uid or gid
+// of -1 keeps the owner of an existing file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, uid, gid int) error {
+	if fi, err := os.Stat(path); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if uid < 0 {
+				uid = int(st.Uid)
+			}
+			if gid < 0 {
+				gid = int(st.Gid)
+			}
+		}
+	}
+	var chown func(string) error
+	if uid >= 0 || gid >= 0 {
+		chown = func(tmp string) error {
+			return os.Chown(tmp, uid, gid)
+		}
+	}
+	return atomicfile.Write(path, data, perm, chown)
+}
+
+// parses an octal permission string, returning def when it is empty
+func parsePermissions(s string, def os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return def, nil
+	}
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(perm), nil
+}
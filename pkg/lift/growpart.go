@@ -0,0 +1,272 @@
+package lift
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sysfs reports partition starts and sizes in 512-byte sectors,
+	// whatever the logical sector size of the disk
+	sectorSize = 512
+	// a GPT keeps a backup of its partition array (16KiB) and header (one
+	// logical sector) at the end of the disk
+	gptEntriesSize = 16384
+)
+
+var (
+	// root is not on a partition that can be grown, e.g. a tmpfs or LVM volume
+	errNoRootPartition = errors.New("root filesystem is not on a partition")
+
+	// packages providing the online resize tool for each supported filesystem
+	growFSPackage = map[string]string{
+		"ext4":  "e2fsprogs-extra",
+		"xfs":   "xfsprogs-extra",
+		"btrfs": "btrfs-progs",
+	}
+)
+
+// rootPartition describes the partition the root filesystem is mounted from
+type rootPartition struct {
+	Device     string
+	Disk       string
+	Number     int
+	Start      uint64
+	Size       uint64
+	DiskSize   uint64
+	FSType     string
+	MountPoint string
+}
+
+// growPartSetup extends the partition holding the root filesystem to the end
+// of the disk, and then resizes the filesystem online.
+func (l *Lift) growPartSetup() error {
+	if l.Data.GrowPart == nil {
+		log.Debug("No growpart configured")
+		return nil
+	}
+
+	root, err := findRootPartition()
+	if err == errNoRootPartition {
+		log.Infof("growpart: %v; not growing", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"device":    root.Device,
+		"disk":      root.Disk,
+		"partition": root.Number,
+		"fstype":    root.FSType,
+	}).Debug("Detected root partition")
+
+	if _, ok := growFSPackage[root.FSType]; !ok {
+		return fmt.Errorf("growpart: unsupported root filesystem %s", root.FSType)
+	}
+
+	last, err := isLastPartition(root)
+	if err != nil {
+		return err
+	}
+	if !last {
+		log.Infof("%s is not the last partition on %s; not growing", root.Device, root.Disk)
+		return nil
+	}
+
+	end := root.DiskSize
+	if lbs := logicalSectorSize(root.Disk); isGPT(root.Disk, lbs) {
+		end -= (gptEntriesSize + lbs) / sectorSize
+	}
+	newSize := end - root.Start
+	if newSize <= root.Size {
+		log.Infof("%s already fills %s", root.Device, root.Disk)
+		return nil
+	}
+
+	oldSize, grownSize := formatBytes(root.Size*sectorSize), formatBytes(newSize*sectorSize)
+	log.WithFields(log.Fields{
+		"device":  root.Device,
+		"oldsize": oldSize,
+		"newsize": grownSize,
+	}).Info("Growing root partition")
+	if l.Data.GrowPart.DryRun {
+		log.Info("growpart dry-run; no changes made")
+		l.Report.Add("growpart", fmt.Sprintf("dry-run: %s would grow from %s to %s", root.Device, oldSize, grownSize))
+		return nil
+	}
+
+	log.Debug("Installing growpart prerequisites")
+	if err := l.apkAdd("cloud-utils-growpart", growFSPackage[root.FSType]); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("growpart", root.Disk, strconv.Itoa(root.Number))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("growpart %s %d: %v: %s", root.Disk, root.Number, err, strings.TrimSpace(stderr.String()))
+	}
+
+	log.Debugf("Resizing %s filesystem on %s", root.FSType, root.MountPoint)
+	switch root.FSType {
+	case "ext4":
+		cmd = exec.Command("resize2fs", root.Device)
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", root.MountPoint)
+	case "btrfs":
+		cmd = exec.Command("btrfs", "filesystem", "resize", "max", root.MountPoint)
+	}
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("resizing %s filesystem: %v: %s", root.FSType, err, strings.TrimSpace(stderr.String()))
+	}
+	l.Report.Add("growpart", fmt.Sprintf("grown %s from %s to %s", root.Device, oldSize, grownSize))
+	return nil
+}
+
+// finds the block device and disk of the root filesystem using mountinfo and sysfs
+func findRootPartition() (*rootPartition, error) {
+	mnts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter("/"))
+	if err != nil {
+		return nil, err
+	}
+	if len(mnts) == 0 {
+		return nil, errors.New("growpart: root filesystem not found in mountinfo")
+	}
+	// the last entry is the one visible, in case of overmounts
+	mnt := mnts[len(mnts)-1]
+
+	sysPath, err := rootDeviceSysPath(mnt)
+	if err != nil {
+		return nil, err
+	}
+	num, err := readSysUint(filepath.Join(sysPath, "partition"))
+	if err != nil {
+		// e.g. a whole disk or an LVM volume
+		return nil, errNoRootPartition
+	}
+	start, err := readSysUint(filepath.Join(sysPath, "start"))
+	if err != nil {
+		return nil, err
+	}
+	size, err := readSysUint(filepath.Join(sysPath, "size"))
+	if err != nil {
+		return nil, err
+	}
+	diskPath := filepath.Dir(sysPath)
+	diskSize, err := readSysUint(filepath.Join(diskPath, "size"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &rootPartition{
+		Device:     "/dev/" + filepath.Base(sysPath),
+		Disk:       "/dev/" + filepath.Base(diskPath),
+		Number:     int(num),
+		Start:      start,
+		Size:       size,
+		DiskSize:   diskSize,
+		FSType:     mnt.FSType,
+		MountPoint: mnt.Mountpoint,
+	}, nil
+}
+
+// resolves the sysfs directory of the root device. The mount source is
+// used, since btrfs reports an anonymous device number in mountinfo;
+// aliases like /dev/root are resolved through the device number instead.
+func rootDeviceSysPath(mnt *mountinfo.Info) (string, error) {
+	if strings.HasPrefix(mnt.Source, "/dev/") {
+		if dev, err := filepath.EvalSymlinks(mnt.Source); err == nil {
+			if p, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(dev))); err == nil {
+				return p, nil
+			}
+		}
+	}
+	if mnt.Major == 0 {
+		// e.g. tmpfs (diskless mode)
+		return "", errNoRootPartition
+	}
+	p, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", mnt.Major, mnt.Minor))
+	if err != nil {
+		return "", errNoRootPartition
+	}
+	return p, nil
+}
+
+// checks that no other partition on the disk starts after the given one
+func isLastPartition(p *rootPartition) (bool, error) {
+	diskPath := filepath.Join("/sys/class/block", filepath.Base(p.Disk))
+	entries, err := ioutil.ReadDir(diskPath)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		start, err := readSysUint(filepath.Join(diskPath, e.Name(), "start"))
+		if err != nil {
+			// not a partition
+			continue
+		}
+		if start > p.Start {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// returns the logical sector size of a disk, defaulting to 512 bytes
+func logicalSectorSize(disk string) uint64 {
+	n, err := readSysUint(filepath.Join("/sys/block", filepath.Base(disk), "queue/logical_block_size"))
+	if err != nil || n == 0 {
+		return sectorSize
+	}
+	return n
+}
+
+// checks for the GPT header signature in LBA 1, given the logical sector size
+func isGPT(disk string, lbs uint64) bool {
+	f, err := os.Open(disk)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sig := make([]byte, 8)
+	if _, err := f.ReadAt(sig, int64(lbs)); err != nil {
+		return false
+	}
+	return string(sig) == "EFI PART"
+}
+
+// reads a single unsigned integer value from a sysfs file
+func readSysUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// formats a byte count in human readable (binary) units
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
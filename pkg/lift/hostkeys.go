@@ -0,0 +1,100 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sshHostKeyDir = "/etc/ssh"
+)
+
+var (
+	sshHostKeyTypes = map[string]bool{
+		"rsa":     true,
+		"ecdsa":   true,
+		"ed25519": true,
+	}
+)
+
+// returns the path of the private host key of the given type
+func hostKeyPath(keyType string) string {
+	return filepath.Join(sshHostKeyDir, fmt.Sprintf("ssh_host_%s_key", keyType))
+}
+
+// regenerates and/or installs sshd host keys, as configured in `sshd.host_keys:`
+func (l *Lift) sshdHostKeysSetup() error {
+	hk := l.Data.SSHDConfig.HostKeys
+	if hk == nil {
+		return nil
+	}
+
+	for _, t := range hk.Regenerate {
+		t = strings.ToLower(t)
+		if !sshHostKeyTypes[t] {
+			return fmt.Errorf("unsupported host key type %s", t)
+		}
+		path := hostKeyPath(t)
+		log.Infof("Regenerating %s host key", t)
+		for _, f := range []string{path, path + ".pub"} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		out, err := exec.Command("ssh-keygen", "-q", "-N", "", "-t", t, "-f", path).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("generating %s host key: %v: %s", t, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	for _, k := range hk.Keys {
+		t := strings.ToLower(k.Type)
+		if !sshHostKeyTypes[t] {
+			return fmt.Errorf("unsupported host key type %s", k.Type)
+		}
+		if k.Private == "" || k.Public == "" {
+			return fmt.Errorf("host key %s needs both a private and public key", t)
+		}
+		path := hostKeyPath(t)
+		log.Infof("Installing %s host key", t)
+		if err := ioutil.WriteFile(path, []byte(strings.TrimSpace(k.Private)+"\n"), 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path+".pub", []byte(strings.TrimSpace(k.Public)+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prints the fingerprints of all host keys to the console,
+// and adds them to the run report
+func (l *Lift) publishHostKeyFingerprints() {
+	pubs, _ := filepath.Glob(filepath.Join(sshHostKeyDir, "ssh_host_*_key.pub"))
+	var fps []string
+	for _, pub := range pubs {
+		out, err := exec.Command("ssh-keygen", "-l", "-f", pub).Output()
+		if err != nil {
+			log.Debugf("Error reading fingerprint of %s: %v", pub, err)
+			continue
+		}
+		fps = append(fps, strings.TrimSpace(string(out)))
+	}
+	if len(fps) == 0 {
+		return
+	}
+	l.Report.Add("ssh host keys", fps...)
+	if !silent {
+		fmt.Println("-----BEGIN SSH HOST KEY FINGERPRINTS-----")
+		for _, fp := range fps {
+			fmt.Println(fp)
+		}
+		fmt.Println("-----END SSH HOST KEY FINGERPRINTS-----")
+	}
+}
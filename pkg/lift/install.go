@@ -0,0 +1,362 @@
+package lift
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	installedLiftBin  = "/usr/local/bin/lift"
+	installedDataFile = "/etc/lift/alpine-data.yaml"
+	installedRCFile   = "/etc/init.d/lift"
+)
+
+var (
+	answerFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+)
+
+// answerFileData holds the rendered values of a setup-alpine answerfile
+type answerFileData struct {
+	Keymap     string
+	HostName   string
+	Interfaces string
+	DNS        string
+	TimeZone   string
+	Proxy      string
+	APKRepos   string
+	NTP        string
+	Disk       string
+}
+
+// derives the setup-alpine answerfile values from alpine-data
+func newAnswerFileData(d *AlpineData) (answerFileData, error) {
+	af := answerFileData{
+		Keymap:     d.Keymap,
+		HostName:   "alpine",
+		Interfaces: defaultInterfaces,
+		TimeZone:   d.TimeZone,
+		Proxy:      "none",
+		APKRepos:   "-1",
+		NTP:        "none",
+		Disk:       "none",
+	}
+	if n := d.Network; n != nil {
+		if n.HostName != "" {
+			af.HostName = strings.Split(n.HostName, ".")[0]
+		}
+		if n.InterfaceOpts != "" {
+			af.Interfaces = n.InterfaceOpts
+		} else {
+			af.Interfaces = fmt.Sprintf(defaultInterfacesHostname, af.HostName)
+		}
+		if r := n.ResolvConf; r != nil {
+			af.DNS = dnsOpts(r)
+		}
+		if n.Proxy != nil && n.Proxy.HTTP != "" {
+			af.Proxy = n.Proxy.HTTP
+		}
+		if n.NTP != nil && (len(n.NTP.Pools) > 0 || len(n.NTP.Servers) > 0) {
+			af.NTP = n.NTP.client()
+		}
+	}
+	if p := d.Packages; p != nil && p.Mirror != "" {
+		af.APKRepos = p.Mirror
+	}
+	if i := d.Install; i != nil && i.Disk != "" {
+		af.Disk = fmt.Sprintf("-m %s %s", i.mode(), i.Disk)
+	} else if d.ScratchDisk != nil && d.ScratchDisk.Device != "" {
+		af.Disk = fmt.Sprintf("-q -m data %s", d.ScratchDisk.Device)
+	}
+	// setup-alpine only runs setup-dns without DHCP, and it prompts
+	// for nameservers when none are given
+	if !hasDHCPInterface(af.Interfaces) &&
+		(d.Network == nil || d.Network.ResolvConf == nil || len(d.Network.ResolvConf.NameServers) == 0) {
+		return af, fmt.Errorf("install: static interfaces need resolv_conf nameservers")
+	}
+
+	// the answerfile is sourced by setup-alpine, and values are double quoted
+	for _, v := range []*string{&af.Keymap, &af.HostName, &af.Interfaces, &af.DNS, &af.TimeZone,
+		&af.Proxy, &af.APKRepos, &af.NTP, &af.Disk} {
+		*v = answerFileEscaper.Replace(*v)
+	}
+	return af, nil
+}
+
+// returns the setup-dns options for the search domain and nameservers.
+// setup-dns takes a single search domain, so only the first is used;
+// lift writes the full search list when it configures resolv_conf.
+func dnsOpts(r *ResolvConfiguration) string {
+	var opts, domains []string
+	for _, d := range append([]string{r.Domain}, r.SearchDomains...) {
+		if d != "" && (len(domains) == 0 || d != domains[0]) {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) > 0 {
+		opts = append(opts, "-d", domains[0])
+	}
+	if len(domains) > 1 {
+		log.Warnf("setup-dns takes one search domain, using %s until resolv_conf is applied", domains[0])
+	}
+	return strings.Join(append(opts, r.NameServers...), " ")
+}
+
+// checks if an interfaces(5) file configures any interface through DHCP
+func hasDHCPInterface(interfaces string) bool {
+	for _, line := range strings.Split(interfaces, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "iface" && fields[3] == "dhcp" {
+			return true
+		}
+	}
+	return false
+}
+
+// renders a setup-alpine answerfile from alpine-data
+func writeAnswerFile(d *AlpineData, w io.Writer) error {
+	af, err := newAnswerFileData(d)
+	if err != nil {
+		return err
+	}
+	return answerFile.Execute(w, af)
+}
+
+// WriteAnswerFile parses alpine-data and writes the equivalent
+// setup-alpine answerfile to w
+func WriteAnswerFile(alpineData []byte, w io.Writer) error {
+	d := InitAlpineData()
+	if err := yaml.Unmarshal(alpineData, d); err != nil {
+		return err
+	}
+	return writeAnswerFile(d, w)
+}
+
+// returns the setup-disk mode, defaulting to sys
+func (i *InstallConfig) mode() string {
+	if i.Mode == "" {
+		return "sys"
+	}
+	return strings.ToLower(i.Mode)
+}
+
+// installs Alpine to disk by running setup-alpine unattended with an
+// answerfile rendered from alpine-data. In sys mode, lift and its
+// alpine-data (without the install block) are copied onto the installed
+// system, so lift configures it on its first boot. In data mode the system
+// keeps running from RAM; lift configures it after the install, and lbu
+// persists the configuration.
+func (l *Lift) installSetup() error {
+	inst := l.Data.Install
+	if inst.Disk == "" {
+		return fmt.Errorf("install: no disk specified")
+	}
+	if m := inst.mode(); m != "sys" && m != "data" {
+		return fmt.Errorf("install: unsupported mode %s", inst.Mode)
+	}
+
+	disk := strings.Fields(inst.Disk)[0]
+	if mounted, err := diskMounted(disk); err != nil {
+		return err
+	} else if mounted {
+		log.WithField("disk", disk).Info("Disk already holds a mounted installation; skipping install")
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile("", "lift-answerfile-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = writeAnswerFile(l.Data, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"disk": inst.Disk,
+		"mode": inst.mode(),
+	}).Info("Running setup-alpine")
+	cmd := exec.Command("setup-alpine", "-e", "-f", tmp.Name())
+	if !silent {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("ERASE_DISKS=%s", inst.Disk))
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("setup-alpine: %v", err)
+	}
+	l.Report.Add("install", fmt.Sprintf("installed to %s (%s mode)", inst.Disk, inst.mode()))
+
+	if inst.mode() == "data" {
+		// the running system is configured next, and persisted with lbu
+		return nil
+	}
+	if err = l.carryConfiguration(disk); err != nil {
+		return err
+	}
+
+	if inst.Reboot {
+		log.Info("Rebooting into the installed system")
+		return exec.Command("reboot").Run()
+	}
+	return nil
+}
+
+// mounts the root partition of the installed system and copies lift, its
+// alpine-data and a first boot service onto it
+func (l *Lift) carryConfiguration(disk string) error {
+	rootDev, err := lastPartition(disk)
+	if err != nil {
+		return err
+	}
+	mnt, err := ioutil.TempDir("", "lift-root-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+	log.Debugf("Mounting %s on %s", rootDev, mnt)
+	if out, err := exec.Command("mount", rootDev, mnt).CombinedOutput(); err != nil {
+		return fmt.Errorf("mounting %s: %v: %s", rootDev, err, strings.TrimSpace(string(out)))
+	}
+	defer func() { _ = exec.Command("umount", mnt).Run() }()
+
+	// setup-alpine -e leaves root without a password, until lift
+	// configures the installed system on its first boot
+	if err = l.targetRootPasswd(mnt); err != nil {
+		return err
+	}
+
+	log.Info("Copying lift configuration into the installed system")
+	self, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	bin, err := ioutil.ReadFile(self)
+	if err != nil {
+		return err
+	}
+	if err = writeInto(mnt, installedLiftBin, bin, 0755); err != nil {
+		return err
+	}
+
+	data, err := stripInstall(l.rawData)
+	if err != nil {
+		return err
+	}
+	if err = writeInto(mnt, installedDataFile, data, 0600); err != nil {
+		return err
+	}
+
+	var rc strings.Builder
+	if err = liftInit.Execute(&rc, "file://"+installedDataFile); err != nil {
+		return err
+	}
+	if err = writeInto(mnt, installedRCFile, []byte(rc.String()), 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(mnt, "etc/runlevels", defaultRunlevel, "lift")
+	if err = os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(installedRCFile, link)
+}
+
+// sets the root password of the system mounted on mnt, or locks it when
+// alpine-data has none
+func (l *Lift) targetRootPasswd(mnt string) error {
+	switch {
+	case l.Data.RootHashedPasswd != "":
+		if !isSHA512Crypt(l.Data.RootHashedPasswd) {
+			return fmt.Errorf("password hash for root is not a SHA-512 crypt hash")
+		}
+		return chpasswdIn(mnt, "root", l.Data.RootHashedPasswd, true)
+	case l.Data.RootPasswd != "":
+		return chpasswdIn(mnt, "root", l.Data.RootPasswd, false)
+	default:
+		return chpasswdIn(mnt, "root", "*", true)
+	}
+}
+
+// checks if a partition of the disk is mounted, e.g. /var of an earlier
+// data mode install
+func diskMounted(disk string) (bool, error) {
+	diskPath := filepath.Join("/sys/class/block", filepath.Base(disk))
+	entries, err := ioutil.ReadDir(diskPath)
+	if err != nil {
+		return false, err
+	}
+	parts := map[string]bool{disk: true}
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(diskPath, e.Name(), "partition")); err == nil {
+			parts["/dev/"+e.Name()] = true
+		}
+	}
+	mnts, err := mountinfo.GetMounts(func(mnt *mountinfo.Info) (skip, stop bool) {
+		return !parts[mnt.Source], false
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(mnts) > 0, nil
+}
+
+// writes a file below the given root directory
+func writeInto(root, path string, data []byte, perm os.FileMode) error {
+	p := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, perm)
+}
+
+// returns the alpine-data with its `install:` block removed
+func stripInstall(data []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var out yaml.MapSlice
+	for _, item := range doc {
+		if item.Key != "install" {
+			out = append(out, item)
+		}
+	}
+	return yaml.Marshal(out)
+}
+
+// returns the partition starting last on the disk, which is where
+// setup-disk places the root filesystem in sys mode
+func lastPartition(disk string) (string, error) {
+	diskPath := filepath.Join("/sys/class/block", filepath.Base(disk))
+	entries, err := ioutil.ReadDir(diskPath)
+	if err != nil {
+		return "", err
+	}
+	last := ""
+	var lastStart uint64
+	for _, e := range entries {
+		start, err := readSysUint(filepath.Join(diskPath, e.Name(), "start"))
+		if err != nil {
+			continue
+		}
+		if last == "" || start > lastStart {
+			last, lastStart = e.Name(), start
+		}
+	}
+	if last == "" {
+		return "", fmt.Errorf("no partitions found on %s", disk)
+	}
+	return "/dev/" + last, nil
+}
@@ -0,0 +1,282 @@
+// Package kvfile edits key/value style configuration files in place. Keys
+// are matched exactly, comments, blank lines and ordering are preserved, and
+// changes are written atomically.
+package kvfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/atomicfile"
+)
+
+// Format describes how keys and values are separated and quoted
+type Format struct {
+	// Separator between key and value: " ", "=" or ":"
+	Separator string
+	// ShellQuote writes values double quoted, shell variable style,
+	// as used by /etc/conf.d/* and /etc/rc.conf
+	ShellQuote bool
+}
+
+// Predefined formats
+var (
+	Shell  = Format{Separator: "=", ShellQuote: true}
+	Equals = Format{Separator: "="}
+	Space  = Format{Separator: " "}
+	Colon  = Format{Separator: ":"}
+)
+
+// File is a parsed key/value configuration file
+type File struct {
+	Path   string
+	Format Format
+	orig   []string
+	lines  []line
+	mode   os.FileMode
+}
+
+// line is a single line of the file; key is empty for comments and blank lines
+type line struct {
+	raw   string
+	key   string
+	value string
+}
+
+// Load reads and parses a file. A file that does not exist yet results
+// in an empty File, which is created on Save.
+func Load(path string, format Format) (*File, error) {
+	f := &File{Path: path, Format: format, mode: 0644}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		f.mode = fi.Mode().Perm()
+	}
+	f.parse(data)
+	return f, nil
+}
+
+// Parse parses file contents that are not read from disk
+func Parse(data []byte, format Format) *File {
+	f := &File{Format: format, mode: 0644}
+	f.parse(data)
+	return f
+}
+
+func (f *File) parse(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	for _, raw := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		f.orig = append(f.orig, raw)
+		k, v := f.split(raw)
+		f.lines = append(f.lines, line{raw: raw, key: k, value: v})
+	}
+}
+
+// splits a line in key and (unquoted) value; comments and blank lines
+// return an empty key
+func (f *File) split(raw string) (string, string) {
+	s := strings.TrimSpace(raw)
+	if s == "" || strings.HasPrefix(s, "#") {
+		return "", ""
+	}
+	var k, v string
+	if f.Format.Separator == " " {
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			return s, ""
+		}
+		k, v = s[:i], s[i:]
+	} else {
+		i := strings.Index(s, f.Format.Separator)
+		if i < 0 {
+			return s, ""
+		}
+		k, v = s[:i], s[i+len(f.Format.Separator):]
+	}
+	k = strings.TrimSpace(k)
+	v = strings.TrimSpace(v)
+	if f.Format.ShellQuote {
+		v = unquote(v)
+	}
+	return k, v
+}
+
+// Get returns the value of the first occurrence of key
+func (f *File) Get(key string) (string, bool) {
+	for _, l := range f.lines {
+		if l.key == key {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets the value of key. The first occurrence is replaced in place,
+// unless it already has the value, and any further occurrences are removed.
+// A new key is placed after its commented default (e.g. "#key=default") if
+// there is one, or appended.
+func (f *File) Set(key, value string) {
+	nl := line{raw: f.render(key, value), key: key, value: value}
+	found := false
+	var out []line
+	for _, l := range f.lines {
+		if l.key == key {
+			if !found {
+				found = true
+				if l.value == value {
+					// keep the line as written, e.g. unquoted
+					nl = l
+				}
+				out = append(out, nl)
+			}
+			continue
+		}
+		out = append(out, l)
+	}
+	if !found {
+		pos := len(out)
+		for i, l := range out {
+			if l.key != "" {
+				continue
+			}
+			if k, _ := f.split(strings.TrimLeft(strings.TrimSpace(l.raw), "# ")); k == key {
+				pos = i + 1
+				break
+			}
+		}
+		out = append(out[:pos], append([]line{nl}, out[pos:]...)...)
+	}
+	f.lines = out
+}
+
+// Delete removes all occurrences of key
+func (f *File) Delete(key string) {
+	var out []line
+	for _, l := range f.lines {
+		if l.key != key {
+			out = append(out, l)
+		}
+	}
+	f.lines = out
+}
+
+// renders a key/value line in the file's format
+func (f *File) render(key, value string) string {
+	if f.Format.ShellQuote {
+		value = quote(value)
+	}
+	switch f.Format.Separator {
+	case ":":
+		return fmt.Sprintf("%s: %s", key, value)
+	case " ":
+		return fmt.Sprintf("%s %s", key, value)
+	default:
+		return fmt.Sprintf("%s%s%s", key, f.Format.Separator, value)
+	}
+}
+
+// Bytes renders the file
+func (f *File) Bytes() []byte {
+	var b strings.Builder
+	for _, l := range f.lines {
+		b.WriteString(l.raw)
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+// Changed reports whether the file differs from what was loaded
+func (f *File) Changed() bool {
+	if len(f.orig) != len(f.lines) {
+		return true
+	}
+	for i, l := range f.lines {
+		if f.orig[i] != l.raw {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns the changed lines, prefixed with "-" for removed and "+" for
+// added lines, in file order
+func (f *File) Diff() string {
+	cur := make([]string, len(f.lines))
+	for i, l := range f.lines {
+		cur[i] = l.raw
+	}
+	return diff(f.orig, cur)
+}
+
+// Save atomically writes the file, through a temporary file in the same
+// directory that is renamed into place. The mode of an existing file is kept.
+func (f *File) Save() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	if err := atomicfile.Write(f.Path, f.Bytes(), f.mode, nil); err != nil {
+		return err
+	}
+	f.orig = strings.Split(strings.TrimSuffix(string(f.Bytes()), "\n"), "\n")
+	return nil
+}
+
+// quotes a value for use as a shell variable assignment
+func quote(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	return `"` + r.Replace(v) + `"`
+}
+
+// strips shell quotes from a value
+func unquote(v string) string {
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		return v[1 : len(v)-1]
+	}
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		r := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, `$`, "\\`", "`")
+		return r.Replace(v[1 : len(v)-1])
+	}
+	return v
+}
+
+// diffs two sets of lines based on their longest common subsequence
+func diff(a, b []string) string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
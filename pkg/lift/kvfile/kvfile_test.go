@@ -0,0 +1,235 @@
+package kvfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		in     string
+		key    string
+		value  string
+		want   string
+	}{
+		{
+			name:   "replace exact key",
+			format: Shell,
+			in:     "rc_parallel=\"NO\"\nrc_logger=\"NO\"\n",
+			key:    "rc_logger",
+			value:  "YES",
+			want:   "rc_parallel=\"NO\"\nrc_logger=\"YES\"\n",
+		},
+		{
+			name:   "no substring match",
+			format: Shell,
+			in:     "rc_logger_file=\"/var/log/rc.log\"\n",
+			key:    "rc_logger",
+			value:  "YES",
+			want:   "rc_logger_file=\"/var/log/rc.log\"\nrc_logger=\"YES\"\n",
+		},
+		{
+			name:   "after commented default",
+			format: Shell,
+			in:     "# settings\n#rc_logger=\"NO\"\nrc_parallel=\"NO\"\n",
+			key:    "rc_logger",
+			value:  "YES",
+			want:   "# settings\n#rc_logger=\"NO\"\nrc_logger=\"YES\"\nrc_parallel=\"NO\"\n",
+		},
+		{
+			name:   "duplicates removed",
+			format: Equals,
+			in:     "a=1\nb=2\na=3\n",
+			key:    "a",
+			value:  "4",
+			want:   "a=4\nb=2\n",
+		},
+		{
+			name:   "space separated",
+			format: Space,
+			in:     "Port 22\nPortForwarding no\n",
+			key:    "Port",
+			value:  "2222",
+			want:   "Port 2222\nPortForwarding no\n",
+		},
+		{
+			name:   "colon separated",
+			format: Colon,
+			in:     "postmaster: root\n",
+			key:    "root",
+			value:  "ops@example.com",
+			want:   "postmaster: root\nroot: ops@example.com\n",
+		},
+		{
+			name:   "unchanged unquoted value",
+			format: Shell,
+			in:     "KEY=val\n",
+			key:    "KEY",
+			value:  "val",
+			want:   "KEY=val\n",
+		},
+		{
+			name:   "unchanged value with spaces",
+			format: Equals,
+			in:     "k = v\nk = w\n",
+			key:    "k",
+			value:  "v",
+			want:   "k = v\n",
+		},
+		{
+			name:   "empty file",
+			format: Equals,
+			in:     "",
+			key:    "a",
+			value:  "1",
+			want:   "a=1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Parse([]byte(tt.in), tt.format)
+			f.Set(tt.key, tt.value)
+			if got := string(f.Bytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if v, ok := f.Get(tt.key); !ok || v != tt.value {
+				t.Errorf("Get(%q) = %q, %v; want %q", tt.key, v, ok, tt.value)
+			}
+		})
+	}
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain",
+		"with spaces",
+		`double "quotes"`,
+		`back\slash`,
+		"$HOME and `cmd`",
+		"single 'quotes'",
+	}
+	for _, v := range values {
+		if got := unquote(quote(v)); got != v {
+			t.Errorf("unquote(quote(%q)) = %q", v, got)
+		}
+		f := Parse(nil, Shell)
+		f.Set("KEY", v)
+		f = Parse(f.Bytes(), Shell)
+		if got, _ := f.Get("KEY"); got != v {
+			t.Errorf("reparsed %q as %q", v, got)
+		}
+	}
+	if got := unquote("'$literal'"); got != "$literal" {
+		t.Errorf("unquote single quoted = %q", got)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		key  string
+		want string
+	}{
+		{"all occurrences", "a=1\nb=2\na=3\n", "a", "b=2\n"},
+		{"keeps comments", "#a=0\na=1\n", "a", "#a=0\n"},
+		{"no substring match", "ab=1\n", "a", "ab=1\n"},
+		{"missing key", "b=2\n", "a", "b=2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Parse([]byte(tt.in), Equals)
+			f.Delete(tt.key)
+			if got := string(f.Bytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		edit    func(f *File)
+		changed bool
+		want    string
+	}{
+		{
+			name:    "unchanged",
+			in:      "a = 1\n",
+			edit:    func(f *File) { f.Set("a", "1") },
+			changed: false,
+			want:    "",
+		},
+		{
+			name:    "replaced",
+			in:      "a=1\nb=2\n",
+			edit:    func(f *File) { f.Set("a", "3") },
+			changed: true,
+			want:    "-a=1\n+a=3\n",
+		},
+		{
+			name:    "added and deleted",
+			in:      "a=1\nb=2\n",
+			edit:    func(f *File) { f.Delete("a"); f.Set("c", "3") },
+			changed: true,
+			want:    "-a=1\n+c=3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Parse([]byte(tt.in), Equals)
+			tt.edit(f)
+			if f.Changed() != tt.changed {
+				t.Errorf("Changed() = %v, want %v", f.Changed(), tt.changed)
+			}
+			if got := f.Diff(); got != tt.want {
+				t.Errorf("Diff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf")
+	if err = ioutil.WriteFile(path, []byte("a=\"1\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path, Shell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Set("a", "2")
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Changed() {
+		t.Error("Changed() after Save")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a=\"2\"\n" {
+		t.Errorf("saved %q", b)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,68 @@
+package lift
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	log "github.com/sirupsen/logrus"
+)
+
+// detects diskless (run-from-RAM) mode, in which the root filesystem is a tmpfs
+func isDiskless() bool {
+	mnts, err := mountinfo.GetMounts(mountinfo.SingleEntryFilter("/"))
+	if err != nil || len(mnts) == 0 {
+		return false
+	}
+	return mnts[len(mnts)-1].FSType == "tmpfs"
+}
+
+// marks paths written by lift, so they are included in the
+// local backup (lbu) when running in diskless mode
+func (l *Lift) persist(paths ...string) {
+	l.persistPaths = append(l.persistPaths, paths...)
+}
+
+// adds the paths written by lift to the lbu include list, and commits the
+// local backup. lbu already backs up /etc, so only other paths are included.
+func (l *Lift) lbuSetup() error {
+	cfg := l.Data.LBU
+	enabled := isDiskless()
+	if cfg != nil && cfg.Enabled != nil {
+		enabled = *cfg.Enabled
+	}
+	if !enabled {
+		log.Debug("Not in diskless mode; skipping lbu")
+		return nil
+	}
+
+	paths := l.persistPaths
+	if cfg != nil {
+		paths = append(paths, cfg.Include...)
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		if seen[p] || p == "/etc" || strings.HasPrefix(p, "/etc/") {
+			continue
+		}
+		seen[p] = true
+		log.Debugf("lbu include %s", p)
+		if err := runRC("lbu", "include", p); err != nil {
+			return err
+		}
+		l.Report.Add("lbu", fmt.Sprintf("included %s", p))
+	}
+
+	args := []string{"commit"}
+	if cfg != nil && cfg.Media != "" {
+		args = append(args, cfg.Media)
+	}
+	log.Info("Committing local backup (lbu)")
+	if err := runRC("lbu", args...); err != nil {
+		return err
+	}
+	l.Report.Add("lbu", "committed")
+	return nil
+}
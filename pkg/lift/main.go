@@ -18,6 +18,22 @@ type Lift struct {
 	DataURL        string
 	RequestHeaders http.Header
 	Data           *AlpineData
+	Report         *Report
+
+	// global options for lift's own apk invocations
+	apkOptions []string
+	// whether apkOptions have been determined
+	apkOptionsSet bool
+	// paths written by lift outside /etc, to be included by lbu
+	persistPaths []string
+	// alpine-data as downloaded
+	rawData []byte
+	// instance facts, gathered on first use
+	facts *Facts
+	// state of earlier runs
+	state *liftState
+	// whether only the per-boot tasks run
+	perBoot bool
 }
 
 // New returns a new Lift instance with initial configuration
@@ -26,11 +42,14 @@ func New(dataURL string, requestHeaders http.Header) (*Lift, error) {
 		DataURL:        dataURL,
 		RequestHeaders: requestHeaders,
 		Data:           InitAlpineData(),
+		Report:         NewReport(),
 	}, nil
 }
 
 // Start contains the main program loop
-func (l *Lift) Start() error {
+func (l *Lift) Start() (err error) {
+	defer func() { l.writeReport(err) }()
+
 	// If alpine-lift-silent kernel boot param is set, silence all logging/output
 	if s, err := getKernelBootParam("alpine-lift-silent"); err == nil && s != "" {
 		log.SetOutput(ioutil.Discard)
@@ -45,7 +64,6 @@ func (l *Lift) Start() error {
 	log.Info("Lift starting...")
 	// If url not provided, read it from the kernel boot parameters
 	if l.DataURL == "" {
-		var err error
 		if l.DataURL, err = getKernelBootParam("alpine-data"); err != nil {
 			return err
 		}
@@ -54,6 +72,7 @@ func (l *Lift) Start() error {
 		}
 	}
 	log.WithField("url", l.DataURL).Info("downloading alpine-data file")
+	l.state = loadState()
 	data, err := downloadFile(l.DataURL, l.RequestHeaders)
 	if err != nil {
 		return err
@@ -62,12 +81,38 @@ func (l *Lift) Start() error {
 	if err = yaml.Unmarshal(data, l.Data); err != nil {
 		return err
 	}
+	l.rawData = data
+
+	if l.configured() {
+		log.Info("Instance already configured; running per-boot tasks")
+		l.perBoot = true
+		return l.perBootSetup()
+	}
+
+	log.Info("Executing boot commands")
+	if err = l.runCommands("bootcmd", l.Data.BootCMD); err != nil {
+		return err
+	}
+
+	if l.Data.Install != nil {
+		log.Info("Installing Alpine to disk")
+		if err = l.installSetup(); err != nil || l.Data.Install.mode() != "data" {
+			return err
+		}
+		// in data mode the system keeps running from RAM, so it is
+		// configured now, and its configuration is persisted with lbu
+	}
 
 	log.Info("Set root password")
 	if err = l.rootPasswdSetup(); err != nil {
 		return err
 	}
 
+	log.Info("Grow root partition")
+	if err = l.growPartSetup(); err != nil {
+		return err
+	}
+
 	log.Info("Executing setup-disk")
 	if err = l.scratchDiskSetup(); err != nil {
 		return err
@@ -110,6 +155,16 @@ func (l *Lift) Start() error {
 		return err
 	}
 
+	log.Info("Setup Docker proxy")
+	if err = l.dockerProxySetup(); err != nil {
+		return err
+	}
+
+	log.Info("Editing configuration files")
+	if err = l.configFilesSetup(); err != nil {
+		return err
+	}
+
 	log.Info("Setup SSHD configuration")
 	if err = l.sshdSetup(); err != nil {
 		return err
@@ -127,8 +182,12 @@ func (l *Lift) Start() error {
 	log.Info("Creating Users")
 	for _, user := range l.Data.Users {
 		log.Infof("Creating user %s", user.Name)
-		if err = createOSUser(user); err != nil {
-			log.Debugf("Error creating user %s: %v", user.Name, err)
+		user.SSHAuthorizedKeys = append(user.SSHAuthorizedKeys, l.importSSHKeys(user.SSHImportID)...)
+		if err = l.createOSUser(user); err != nil {
+			log.Errorf("Error creating user %s: %v", user.Name, err)
+		}
+		if home, err := userHomeDir(user.Name); err == nil && !user.NoCreateHomeDir {
+			l.persist(home)
 		}
 	}
 
@@ -145,7 +204,7 @@ func (l *Lift) Start() error {
 	}
 
 	log.Info("Writing files")
-	if err = l.createFiles(); err != nil {
+	if err = l.createFiles(false); err != nil {
 		return err
 	}
 
@@ -154,23 +213,46 @@ func (l *Lift) Start() error {
 		return err
 	}
 
+	log.Info("Setup services")
+	if err = l.servicesSetup(); err != nil {
+		return err
+	}
+
+	log.Info("Writing deferred files")
+	if err = l.createFiles(true); err != nil {
+		return err
+	}
+
 	log.Info("Executing post-install commands")
-	for _, c := range l.Data.RunCMD {
-		c = append([]string{"-c"}, c...)
-		cmd := exec.Command("sh", c...)
-		cmd.Env = os.Environ()
-		log.Debugf("exec: sh -c \"%s\"", c[1:])
-		err := cmd.Run()
-		if err != nil {
-			log.Debugf("err: %s", err)
+	if err = l.runCommands("runcmd", l.Data.RunCMD); err != nil {
+		return err
+	}
+
+	log.Info("Running scripts")
+	if err = l.scriptsSetup(); err != nil {
+		return err
+	}
+
+	if l.Data.MTA != nil && l.Data.MTA.TestRecipient != "" {
+		log.Info("Sending MTA test mail")
+		if err := l.sendTestMail(); err != nil {
+			log.Errorf("Error sending test mail: %v", err)
 		}
 	}
 
 	// Final SSH restart because of added keys etc.
 	_ = doService("sshd", RESTART)
 
+	log.Info("Saving lift state")
+	if err = l.completeInstance(); err != nil {
+		return err
+	}
+
 	// Delete the lift binary from the system
 	if l.Data.UnLift {
+		if l.Data.BootCMDEveryBoot {
+			log.Warn("unlift is set; bootcmd will not run on later boots")
+		}
 		log.Info("Removing lift binary from the system")
 		binPath, err := os.Readlink("/proc/self/exe")
 		if err != nil {
@@ -180,6 +262,24 @@ func (l *Lift) Start() error {
 		if err = os.Remove(binPath); err != nil {
 			return err
 		}
+		// the lift service installed with the binary would fail on every boot
+		if serviceExists("lift") {
+			log.Info("Removing lift service from the system")
+			_ = disableService("lift", defaultRunlevel)
+			if err = os.Remove(installedRCFile); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	log.Info("Local backup (diskless mode)")
+	if err = l.lbuSetup(); err != nil {
+		return err
+	}
+
+	if l.Data.Install != nil && l.Data.Install.Reboot {
+		log.Info("Rebooting into the installed system")
+		return exec.Command("reboot").Run()
 	}
 
 	log.Info("Lift successfully completed")
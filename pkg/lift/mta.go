@@ -0,0 +1,277 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/kvfile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mtaSSMTP        = "ssmtp"
+	mtaMSMTP        = "msmtp"
+	mtaPostfixRelay = "postfix-relay"
+
+	aliasesFile     = "/etc/aliases"
+	msmtpConfFile   = "/etc/msmtprc"
+	postfixSASLFile = "/etc/postfix/sasl_passwd"
+)
+
+// msmtpTemplateData is the data for the msmtprc template
+type msmtpTemplateData struct {
+	MTA         *MTAConfiguration
+	Host        string
+	Port        int
+	AliasesFile string
+}
+
+// mtaSetup installs and configures the MTA (ssmtp by default) that
+// forwards mail to a smarthost
+func (l *Lift) mtaSetup() error {
+	if l.Data.MTA == nil {
+		log.Debug("No MTA configured")
+		return nil
+	}
+
+	switch l.Data.MTA.mtaType() {
+	case mtaSSMTP:
+		return l.ssmtpSetup()
+	case mtaMSMTP:
+		return l.msmtpSetup()
+	case mtaPostfixRelay:
+		return l.postfixRelaySetup()
+	default:
+		return fmt.Errorf("mta: unsupported type %s", l.Data.MTA.Type)
+	}
+}
+
+// returns the configured MTA type, defaulting to ssmtp
+func (m *MTAConfiguration) mtaType() string {
+	if m.Type == "" {
+		return mtaSSMTP
+	}
+	return m.Type
+}
+
+// splits the server in host and port, defaulting the port to the
+// submission port that matches the TLS settings
+func (m *MTAConfiguration) hostPort() (string, int, error) {
+	host, port, err := net.SplitHostPort(m.Server)
+	if err != nil {
+		// no port given
+		host = m.Server
+		switch {
+		case m.UseTLS:
+			return host, 465, nil
+		case m.UseSTARTTLS:
+			return host, 587, nil
+		default:
+			return host, 25, nil
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("mta: invalid port in server %s", m.Server)
+	}
+	return host, p, nil
+}
+
+// returns the aliases, with root's mail going to `root:` unless root
+// has an alias already
+func (m *MTAConfiguration) allAliases() map[string]MultiString {
+	aliases := make(map[string]MultiString)
+	for name, rcpts := range m.Aliases {
+		aliases[name] = rcpts
+	}
+	if _, ok := aliases["root"]; !ok && m.Root != "" {
+		aliases["root"] = MultiString{m.Root}
+	}
+	return aliases
+}
+
+// sets the aliases in /etc/aliases, keeping the aliases already there
+func writeAliases(aliases map[string]MultiString) error {
+	f, err := kvfile.Load(aliasesFile, kvfile.Colon)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(aliases) {
+		f.Set(name, strings.Join(aliases[name], ", "))
+	}
+	if !f.Changed() {
+		return nil
+	}
+	log.Debugf("Writing %s", aliasesFile)
+	return f.Save()
+}
+
+// installs and configures ssmtp
+func (l *Lift) ssmtpSetup() error {
+	if err := l.apkAdd("ssmtp"); err != nil {
+		return err
+	}
+	if len(l.Data.MTA.Aliases) > 0 {
+		log.Warn("ssmtp does not support aliases; only root's mail is forwarded")
+	}
+
+	log.Debug("Generating ssmtp.conf")
+	ssmtp, err := generateFileFromTemplate(*ssmtpConf, l.Data)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Copying ssmtp.conf to %s", ssmtpConfFile)
+	cmd := exec.Command("mv", ssmtp, ssmtpConfFile)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	l.persist(ssmtpConfFile)
+
+	return nil
+}
+
+// installs and configures msmtp, which reads the aliases from /etc/aliases
+func (l *Lift) msmtpSetup() error {
+	m := l.Data.MTA
+	if err := l.apkAdd("msmtp", "ca-certificates"); err != nil {
+		return err
+	}
+
+	host, port, err := m.hostPort()
+	if err != nil {
+		return err
+	}
+	if err = writeAliases(m.allAliases()); err != nil {
+		return err
+	}
+	data := msmtpTemplateData{MTA: m, Host: host, Port: port}
+	// msmtp fails on an aliases file that does not exist
+	if _, err = os.Stat(aliasesFile); err == nil {
+		data.AliasesFile = aliasesFile
+		l.persist(aliasesFile)
+	}
+	var b bytes.Buffer
+	if err = msmtpConf.Execute(&b, data); err != nil {
+		return err
+	}
+	log.Debugf("Writing %s", msmtpConfFile)
+	if err = writeFileAtomic(msmtpConfFile, b.Bytes(), 0600, -1, -1); err != nil {
+		return err
+	}
+	// msmtp does not provide the sendmail command by itself
+	if err = exec.Command("ln", "-sf", "/usr/bin/msmtp", "/usr/sbin/sendmail").Run(); err != nil {
+		return err
+	}
+	l.persist(msmtpConfFile, "/usr/sbin/sendmail")
+	return nil
+}
+
+// installs postfix as a send-only MTA that relays all mail to the server
+func (l *Lift) postfixRelaySetup() error {
+	m := l.Data.MTA
+	if err := l.apkAdd("postfix"); err != nil {
+		return err
+	}
+
+	host, port, err := m.hostPort()
+	if err != nil {
+		return err
+	}
+	db := postfixDatabaseType()
+	relayhost := fmt.Sprintf("[%s]:%d", host, port)
+	settings := []string{
+		"relayhost=" + relayhost,
+		"inet_interfaces=loopback-only",
+		"alias_maps=" + db + ":" + aliasesFile,
+		"alias_database=" + db + ":" + aliasesFile,
+	}
+	if m.UseTLS || m.UseSTARTTLS {
+		settings = append(settings,
+			"smtp_tls_security_level=encrypt",
+			"smtp_tls_CAfile=/etc/ssl/certs/ca-certificates.crt")
+	}
+	if m.UseTLS {
+		settings = append(settings, "smtp_tls_wrappermode=yes")
+	}
+	if m.RewriteDomain != "" {
+		settings = append(settings, "myorigin="+m.RewriteDomain)
+	}
+	if m.User != "" {
+		if err = l.apkAdd("cyrus-sasl-login"); err != nil {
+			return err
+		}
+		passwd := fmt.Sprintf("%s %s:%s\n", relayhost, m.User, m.Password)
+		if err = writeFileAtomic(postfixSASLFile, []byte(passwd), 0600, -1, -1); err != nil {
+			return err
+		}
+		if err = runRC("postmap", db+":"+postfixSASLFile); err != nil {
+			return err
+		}
+		settings = append(settings,
+			"smtp_sasl_auth_enable=yes",
+			"smtp_sasl_password_maps="+db+":"+postfixSASLFile,
+			"smtp_sasl_security_options=noanonymous")
+		l.persist(postfixSASLFile, postfixSASLFile+postfixDatabaseSuffix(db))
+	}
+
+	log.Debug("Configuring postfix")
+	if err = runRC("postconf", append([]string{"-e"}, settings...)...); err != nil {
+		return err
+	}
+	if err = writeAliases(m.allAliases()); err != nil {
+		return err
+	}
+	if err = runRC("newaliases"); err != nil {
+		return err
+	}
+	l.persist(aliasesFile, aliasesFile+postfixDatabaseSuffix(db))
+
+	if err = enableService("postfix", defaultRunlevel); err != nil {
+		return err
+	}
+	return doService("postfix", RESTART)
+}
+
+// returns postfix's default lookup table type (lmdb on Alpine)
+func postfixDatabaseType() string {
+	out, err := exec.Command("postconf", "-h", "default_database_type").Output()
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return "lmdb"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// returns the suffix of the files postmap creates for a table type
+func postfixDatabaseSuffix(db string) string {
+	if db == "lmdb" {
+		return ".lmdb"
+	}
+	return ".db"
+}
+
+// sends a verification mail to the test recipient through the
+// sendmail interface of the configured MTA
+func (l *Lift) sendTestMail() error {
+	rcpt := l.Data.MTA.TestRecipient
+	hostname := l.getFacts().Hostname
+	msg := fmt.Sprintf("To: %s\nSubject: lift test mail from %s\n\n"+
+		"This mail verifies the %s configuration of %s.\n",
+		rcpt, hostname, l.Data.MTA.mtaType(), hostname)
+
+	cmd := exec.Command("sendmail", "-t")
+	cmd.Stdin = strings.NewReader(msg)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		l.Report.Add("mta", fmt.Sprintf("test mail to %s failed: %v", rcpt, err))
+		return err
+	}
+	l.Report.Add("mta", fmt.Sprintf("test mail sent to %s", rcpt))
+	return nil
+}
@@ -0,0 +1,272 @@
+package lift
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/kvfile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ntpChrony   = "chrony"
+	ntpOpenNTPD = "openntpd"
+	ntpBusybox  = "busybox"
+
+	rtcSync    = "rtcsync"
+	rtcHWClock = "hwclock"
+	rtcNone    = "none"
+
+	chronyConfFile   = "/etc/chrony/chrony.conf"
+	openntpdConfFile = "/etc/ntpd.conf"
+	busyboxNTPDFile  = confDDir + "/ntpd"
+)
+
+var (
+	// the OpenRC service of each NTP client
+	ntpService = map[string]string{
+		ntpChrony:   "chronyd",
+		ntpOpenNTPD: "openntpd",
+		ntpBusybox:  "ntpd",
+	}
+)
+
+// ntpTemplateData is the data for the chrony and openntpd templates
+type ntpTemplateData struct {
+	Pools    []ntpTemplateSource
+	Servers  []ntpTemplateSource
+	MakeStep NTPMakeStep
+	Allow    []string
+	Deny     []string
+	RTCSync  bool
+}
+
+// ntpTemplateSource is a source with its rendered chrony options
+type ntpTemplateSource struct {
+	Address string
+	Options string
+}
+
+// returns the configured NTP client, defaulting to chrony
+func (n *NTPConfiguration) client() string {
+	if n.Client == "" {
+		return ntpChrony
+	}
+	return n.Client
+}
+
+// returns the configured RTC handling, defaulting to rtcsync
+func (n *NTPConfiguration) rtc() string {
+	if n.RTC == "" {
+		return rtcSync
+	}
+	return n.RTC
+}
+
+// renders the chrony options of a source. Pools use up to 3 sources by default.
+func (s NTPSource) chronyOptions(pool bool) string {
+	var opts []string
+	if s.IBurst == nil || *s.IBurst {
+		opts = append(opts, "iburst")
+	}
+	if s.Prefer {
+		opts = append(opts, "prefer")
+	}
+	if s.NTS {
+		opts = append(opts, "nts")
+	}
+	if s.MinPoll != nil {
+		opts = append(opts, fmt.Sprintf("minpoll %d", *s.MinPoll))
+	}
+	if s.MaxPoll != nil {
+		opts = append(opts, fmt.Sprintf("maxpoll %d", *s.MaxPoll))
+	}
+	if pool {
+		maxSources := s.MaxSources
+		if maxSources == 0 {
+			maxSources = 3
+		}
+		opts = append(opts, fmt.Sprintf("maxsources %d", maxSources))
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return " " + strings.Join(opts, " ")
+}
+
+// returns the pools and servers
+func (n *NTPConfiguration) sources() NTPSources {
+	return append(append(NTPSources{}, n.Pools...), n.Servers...)
+}
+
+// checks if a source has options other clients than chrony don't support
+func (s NTPSource) hasOptions() bool {
+	return s.Prefer || s.NTS || s.MinPoll != nil || s.MaxPoll != nil || s.MaxSources != 0
+}
+
+// returns the data for the NTP client configuration templates
+func (n *NTPConfiguration) templateData() ntpTemplateData {
+	data := ntpTemplateData{
+		MakeStep: NTPMakeStep{Threshold: 1, Limit: 3},
+		Allow:    n.Allow,
+		Deny:     n.Deny,
+		RTCSync:  n.rtc() == rtcSync,
+	}
+	if n.MakeStep != nil {
+		data.MakeStep = *n.MakeStep
+	}
+	for _, s := range n.Pools {
+		data.Pools = append(data.Pools, ntpTemplateSource{Address: s.Address, Options: s.chronyOptions(true)})
+	}
+	for _, s := range n.Servers {
+		data.Servers = append(data.Servers, ntpTemplateSource{Address: s.Address, Options: s.chronyOptions(false)})
+	}
+	return data
+}
+
+// call setup-ntp Alpine setup script for installing the NTP client, and
+// configures it
+func (l *Lift) ntpSetup() error {
+	n := l.Data.Network.NTP
+	if n == nil || (len(n.Pools) == 0 && len(n.Servers) == 0) {
+		log.Debug("No NTP configured")
+		return nil
+	}
+	client := n.client()
+	service, ok := ntpService[client]
+	if !ok {
+		return fmt.Errorf("ntp: unsupported client %s", client)
+	}
+	switch n.rtc() {
+	case rtcSync, rtcHWClock, rtcNone:
+	default:
+		return fmt.Errorf("ntp: unsupported rtc %s", n.RTC)
+	}
+
+	cmd := exec.Command("setup-ntp", "-c", client)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	var err error
+	switch client {
+	case ntpChrony:
+		err = l.writeNTPConfig(chronyConf, chronyConfFile, n.templateData())
+	case ntpOpenNTPD:
+		n.warnUnsupported()
+		err = l.writeNTPConfig(openntpdConf, openntpdConfFile, n.templateData())
+	case ntpBusybox:
+		n.warnUnsupported()
+		err = l.busyboxNTPDSetup()
+	}
+	if err != nil {
+		return err
+	}
+
+	if n.rtc() == rtcHWClock {
+		log.Debug("Enabling hwclock")
+		if err = enableService("hwclock", "boot"); err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("Restart %s", service)
+	_ = doService(service, RESTART)
+
+	if n.WaitSync > 0 {
+		log.Infof("Waiting up to %ds for the clock to be synchronized", n.WaitSync)
+		timeout := time.Duration(n.WaitSync) * time.Second
+		if err = waitForNTPSync(n, timeout); err != nil {
+			log.Warnf("Clock not synchronized: %v", err)
+			l.Report.Add("ntp", fmt.Sprintf("clock not synchronized: %v", err))
+		} else {
+			l.Report.Add("ntp", "clock synchronized")
+		}
+	}
+	return nil
+}
+
+// logs the settings only chrony supports
+func (n *NTPConfiguration) warnUnsupported() {
+	for _, s := range n.sources() {
+		if s.hasOptions() {
+			log.Warnf("ntp: source options of %s are only supported by chrony", s.Address)
+		}
+	}
+	if len(n.Allow) > 0 || len(n.Deny) > 0 {
+		log.Warn("ntp: allow/deny are only supported by chrony; serving time without restrictions")
+	}
+	if n.MakeStep != nil {
+		log.Warn("ntp: makestep is only supported by chrony")
+	}
+}
+
+// renders an NTP client configuration file
+func (l *Lift) writeNTPConfig(t *template.Template, path string, data ntpTemplateData) error {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return err
+	}
+	log.Debugf("Writing %s", path)
+	if err := writeFileAtomic(path, b.Bytes(), 0644, -1, -1); err != nil {
+		return err
+	}
+	l.persist(path)
+	return nil
+}
+
+// configures busybox ntpd through its OpenRC options
+func (l *Lift) busyboxNTPDSetup() error {
+	n := l.Data.Network.NTP
+	opts := []string{"-N"}
+	for _, s := range n.sources() {
+		opts = append(opts, "-p", s.Address)
+	}
+	if len(n.Allow) > 0 {
+		opts = append(opts, "-l")
+	}
+	f, err := kvfile.Load(busyboxNTPDFile, kvfile.Shell)
+	if err != nil {
+		return err
+	}
+	f.Set("NTPD_OPTS", strings.Join(opts, " "))
+	log.Debugf("Writing %s", busyboxNTPDFile)
+	return f.Save()
+}
+
+// waits for the NTP client to synchronize the clock
+func waitForNTPSync(n *NTPConfiguration, timeout time.Duration) error {
+	switch n.client() {
+	case ntpChrony:
+		// chronyc checks once per second
+		tries := fmt.Sprintf("%d", int(timeout/time.Second))
+		return runRC("chronyc", "waitsync", tries, "0", "0", "1")
+	case ntpOpenNTPD:
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			out, _ := exec.Command("ntpctl", "-s", "status").Output()
+			if strings.Contains(string(out), "clock synced") {
+				return nil
+			}
+			time.Sleep(time.Second)
+		}
+		return fmt.Errorf("timeout after %s", timeout)
+	default:
+		// busybox ntpd has no status; set the clock once and quit
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		args := []string{"-n", "-q"}
+		for _, s := range n.sources() {
+			args = append(args, "-p", s.Address)
+		}
+		if out, err := exec.CommandContext(ctx, "ntpd", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+package lift
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/kvfile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	proxyProfileFile = "/etc/profile.d/proxy.sh"
+	dockerConfDFile  = confDDir + "/docker"
+)
+
+// returns the https proxy, defaulting to the http proxy
+func (p *ProxyConfig) https() string {
+	if p.HTTPS == "" {
+		return p.HTTP
+	}
+	return p.HTTPS
+}
+
+// returns the no_proxy entries, which may also be given comma separated
+func (p *ProxyConfig) noProxy() []string {
+	var entries []string
+	for _, np := range p.NoProxy {
+		for _, e := range strings.Split(np, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+// checks if a host is reached directly, because it's a loopback address,
+// or matches a no_proxy entry: "*", an IP address, a CIDR network, or a
+// domain (also matching its subdomains)
+func (p *ProxyConfig) bypass(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, e := range p.noProxy() {
+		if e == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		d := strings.TrimPrefix(e, ".")
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the proxy for a request, for use as http.Transport.Proxy
+func (p *ProxyConfig) proxyURL(req *http.Request) (*url.URL, error) {
+	var proxy string
+	switch req.URL.Scheme {
+	case "http":
+		proxy = p.HTTP
+	case "https":
+		proxy = p.https()
+	}
+	if proxy == "" || p.bypass(req.URL.Hostname()) {
+		return nil, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+// sets the proxy for shell environments through /etc/profile.d, for the
+// commands lift runs (e.g. apk) through its environment, and for lift's
+// own downloads
+func (l *Lift) proxySetup() error {
+	p := l.Data.Network.Proxy
+	if p == nil || (p.HTTP == "" && p.HTTPS == "") {
+		log.Debug("No proxy configured")
+		return nil
+	}
+	log.WithField("proxy", p.HTTP).Debug("Found proxy setting")
+	env := ProxyConfig{HTTP: p.HTTP, HTTPS: p.https(), NoProxy: p.noProxy()}
+
+	var b bytes.Buffer
+	if err := proxyProfile.Execute(&b, env); err != nil {
+		return err
+	}
+	log.Debugf("Writing %s", proxyProfileFile)
+	if err := writeFileAtomic(proxyProfileFile, b.Bytes(), 0644, -1, -1); err != nil {
+		return err
+	}
+	l.persist(proxyProfileFile)
+
+	for _, name := range []string{"http_proxy", "HTTP_PROXY"} {
+		os.Setenv(name, env.HTTP)
+	}
+	for _, name := range []string{"https_proxy", "HTTPS_PROXY"} {
+		os.Setenv(name, env.HTTPS)
+	}
+	for _, name := range []string{"no_proxy", "NO_PROXY"} {
+		os.Setenv(name, strings.Join(env.NoProxy, ","))
+	}
+
+	// http.ProxyFromEnvironment reads the environment only once, so
+	// lift's own downloads get the proxy explicitly
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.Proxy = p.proxyURL
+	}
+	return nil
+}
+
+// exports the proxy to the Docker daemon through its conf.d file, which
+// works with every dockerd version (daemon.json "proxies" needs 23.0)
+func (l *Lift) dockerProxySetup() error {
+	if l.Data.Network == nil {
+		return nil
+	}
+	p := l.Data.Network.Proxy
+	if p == nil || (p.HTTP == "" && p.HTTPS == "") || !serviceExists("docker") {
+		return nil
+	}
+
+	f, err := kvfile.Load(dockerConfDFile, kvfile.Shell)
+	if err != nil {
+		return err
+	}
+	f.Set("export HTTP_PROXY", p.HTTP)
+	f.Set("export HTTPS_PROXY", p.https())
+	if np := p.noProxy(); len(np) > 0 {
+		f.Set("export NO_PROXY", strings.Join(np, ","))
+	} else {
+		f.Delete("export NO_PROXY")
+	}
+	if !f.Changed() {
+		return nil
+	}
+	log.Debugf("Writing %s", dockerConfDFile)
+	if err = f.Save(); err != nil {
+		return err
+	}
+	l.persist(dockerConfDFile)
+	if serviceStarted("docker") {
+		return doService("docker", RESTART)
+	}
+	return nil
+}
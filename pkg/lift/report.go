@@ -0,0 +1,87 @@
+package lift
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	reportFile = "/var/log/lift-report.log"
+	// report of the per-boot tasks, kept apart from the first run's report
+	perBootReportFile = "/var/log/lift-report-boot.log"
+)
+
+// Report collects notable results of a lift run, grouped per module.
+// It is written to reportFile (or perBootReportFile) when lift finishes,
+// also when it fails.
+type Report struct {
+	started  time.Time
+	sections []reportSection
+}
+
+type reportSection struct {
+	module string
+	lines  []string
+}
+
+// NewReport returns an empty run report
+func NewReport() *Report {
+	return &Report{started: time.Now()}
+}
+
+// Add appends lines to the report section of the given module
+func (r *Report) Add(module string, lines ...string) {
+	for i := range r.sections {
+		if r.sections[i].module == module {
+			r.sections[i].lines = append(r.sections[i].lines, lines...)
+			return
+		}
+	}
+	r.sections = append(r.sections, reportSection{module: module, lines: lines})
+}
+
+// WriteTo writes the report in a human readable form
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "lift run started %s\n", r.started.Format(time.RFC3339))
+	for _, s := range r.sections {
+		fmt.Fprintf(&b, "\n[%s]\n", s.module)
+		for _, l := range s.lines {
+			fmt.Fprintf(&b, "%s\n", l)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writes the run report to reportFile, or for per-boot runs to
+// perBootReportFile
+func (l *Lift) writeReport(result error) {
+	path := reportFile
+	if l.perBoot {
+		path = perBootReportFile
+	}
+	if result != nil {
+		l.Report.Add("result", fmt.Sprintf("failed: %v", result))
+	} else {
+		l.Report.Add("result", "completed")
+	}
+	var b strings.Builder
+	_, _ = l.Report.WriteTo(&b)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Errorf("Error writing report: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		log.Errorf("Error writing report: %v", err)
+		return
+	}
+	log.WithField("path", path).Debug("Run report written")
+}
@@ -0,0 +1,100 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	scriptsDir         = stateDir + "/scripts"
+	perBootScripts     = "per-boot"
+	perInstanceScripts = "per-instance"
+	perOnceScripts     = "per-once"
+)
+
+// writes the scripts of the `scripts:` block, and runs the script
+// directories that are due when an instance is configured
+func (l *Lift) scriptsSetup() error {
+	if err := l.writeScripts(); err != nil {
+		return err
+	}
+	for _, freq := range []string{perOnceScripts, perBootScripts, perInstanceScripts} {
+		if err := l.runScripts(freq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// creates the script directories and writes the scripts of the `scripts:` block
+func (l *Lift) writeScripts() error {
+	var sc ScriptsConfig
+	if l.Data.Scripts != nil {
+		sc = *l.Data.Scripts
+	}
+	for freq, scripts := range map[string]map[string]string{
+		perBootScripts:     sc.PerBoot,
+		perInstanceScripts: sc.PerInstance,
+		perOnceScripts:     sc.PerOnce,
+	} {
+		dir := filepath.Join(scriptsDir, freq)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for name, content := range scripts {
+			if name != filepath.Base(name) {
+				return fmt.Errorf("scripts: invalid script name %q", name)
+			}
+			path := filepath.Join(dir, name)
+			log.Debugf("Writing script %s", path)
+			if err := writeFileAtomic(path, []byte(content), 0755, -1, -1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runs the executable files in a script directory in lexical order. A
+// per-once script is recorded in the lift state when it succeeds, and
+// is not run again.
+func (l *Lift) runScripts(freq string) error {
+	dir := filepath.Join(scriptsDir, freq)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if !e.Mode().IsRegular() || e.Mode().Perm()&0111 == 0 {
+			log.Debugf("Skipping %s; not an executable file", path)
+			continue
+		}
+		if freq == perOnceScripts && l.state.ranOnce(e.Name()) {
+			log.Debugf("Skipping %s; already run once", path)
+			continue
+		}
+		log.Infof("Running script %s", path)
+		c := Command{Cmd: CommandLine{Args: []string{path}}}
+		if err := l.runCommands("scripts", []Command{c}); err != nil {
+			return err
+		}
+		if freq == perOnceScripts {
+			l.state.Once = append(l.state.Once, e.Name())
+			if err := l.saveState(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants for service states
+const (
+	START   = "start"
+	RESTART = "restart"
+	STOP    = "stop"
+	RELOAD  = "reload"
+	ZAP     = "zap"
+)
+
+const (
+	defaultRunlevel = "default"
+	confDDir        = "/etc/conf.d"
+)
+
+// checks through OpenRC whether a service (init script) exists
+func serviceExists(name string) bool {
+	return exec.Command("rc-service", "--exists", name).Run() == nil
+}
+
+// checks through OpenRC whether a service is currently started
+func serviceStarted(name string) bool {
+	return exec.Command("rc-service", name, "status").Run() == nil
+}
+
+// interact with openrc to start, stop, restart or reload a service
+func doService(name string, action string) error {
+	if !serviceExists(name) {
+		return fmt.Errorf("service %s does not exist", name)
+	}
+	return runRC("rc-service", name, action)
+}
+
+// polls the OpenRC status of a service until it reaches the wanted state,
+// or returns an error when the timeout expires
+func waitForService(name string, started bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if serviceStarted(name) == started {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			state := "stop"
+			if started {
+				state = "start"
+			}
+			return fmt.Errorf("timeout waiting for %s to %s", name, state)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// adds a service to a runlevel
+func enableService(name, runlevel string) error {
+	if !serviceExists(name) {
+		return fmt.Errorf("service %s does not exist", name)
+	}
+	return runRC("rc-update", "add", name, runlevel)
+}
+
+// removes a service from a runlevel
+func disableService(name, runlevel string) error {
+	return runRC("rc-update", "del", name, runlevel)
+}
+
+// runs an OpenRC (or other Alpine tooling) command, returning its output in case of an error
+func runRC(name string, args ...string) error {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	log.Debugf("exec: %s %s", name, strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// applies the `services:` block
+func (l *Lift) servicesSetup() error {
+	for _, svc := range l.Data.Services {
+		if !serviceExists(svc.Name) {
+			return fmt.Errorf("service %s does not exist", svc.Name)
+		}
+
+		changed := false
+		if len(svc.Options) > 0 {
+			path := fmt.Sprintf("%s/%s", confDDir, svc.Name)
+			diff, err := editConfigFile(ConfigFile{Path: path, Settings: svc.Options})
+			if err != nil {
+				return fmt.Errorf("configuring %s: %v", svc.Name, err)
+			}
+			if diff != "" {
+				changed = true
+				l.Report.Add("services", fmt.Sprintf("%s:", path), strings.TrimSuffix(diff, "\n"))
+			}
+		}
+
+		for _, rl := range svc.Enable {
+			log.Infof("Adding %s to runlevel %s", svc.Name, rl)
+			if err := enableService(svc.Name, rl); err != nil {
+				return err
+			}
+		}
+		for _, rl := range svc.Disable {
+			log.Infof("Removing %s from runlevel %s", svc.Name, rl)
+			if err := disableService(svc.Name, rl); err != nil {
+				return err
+			}
+		}
+
+		action := strings.ToLower(svc.Action)
+		if action == "" && changed && serviceStarted(svc.Name) {
+			// pick up the new options
+			action = RESTART
+		}
+		switch action {
+		case "":
+			continue
+		case START, STOP, RESTART, RELOAD:
+		default:
+			return fmt.Errorf("unsupported action %s for service %s", svc.Action, svc.Name)
+		}
+		log.Infof("Service %s: %s", svc.Name, action)
+		if err := doService(svc.Name, action); err != nil {
+			return err
+		}
+		l.Report.Add("services", fmt.Sprintf("%s: %s", svc.Name, action))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift/atomicfile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sshdConfigFile = "/etc/ssh/sshd_config"
+)
+
+// sshdConfig is a parsed sshd_config file. Keywords are matched
+// case-insensitively, like sshd does, and comments are preserved.
+type sshdConfig struct {
+	lines []sshdConfigLine
+}
+
+// sshdConfigLine is a single line of sshd_config. Keyword is empty for
+// comments and blank lines. Match holds the criteria of the Match block
+// the line belongs to, or is empty for the global section.
+type sshdConfigLine struct {
+	raw     string
+	keyword string
+	match   string
+}
+
+// parses the contents of an sshd_config file
+func parseSSHDConfig(data []byte) *sshdConfig {
+	c := &sshdConfig{}
+	match := ""
+	for _, raw := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		line := sshdConfigLine{raw: raw}
+		kw, args := splitSSHDLine(raw)
+		line.keyword = strings.ToLower(kw)
+		if line.keyword == "match" {
+			match = normalizeMatch(args)
+		}
+		line.match = match
+		c.lines = append(c.lines, line)
+	}
+	return c
+}
+
+// splits a line in keyword and arguments. Keyword and arguments are
+// separated by whitespace and/or a single '='. Returns an empty
+// keyword for comments and blank lines.
+func splitSSHDLine(raw string) (string, string) {
+	s := strings.TrimSpace(raw)
+	if s == "" || strings.HasPrefix(s, "#") {
+		return "", ""
+	}
+	i := strings.IndexAny(s, " \t=")
+	if i < 0 {
+		return s, ""
+	}
+	args := strings.TrimSpace(s[i:])
+	args = strings.TrimSpace(strings.TrimPrefix(args, "="))
+	return s[:i], args
+}
+
+// normalizes Match criteria for comparison
+func normalizeMatch(criteria string) string {
+	return strings.ToLower(strings.Join(strings.Fields(criteria), " "))
+}
+
+// Set replaces the global value(s) of a keyword. The first occurrence is
+// replaced in place and further occurrences are removed. A new keyword is
+// placed after its commented default (e.g. "#Port 22") if there is one, or
+// else before the first Match block.
+func (c *sshdConfig) Set(keyword string, values ...string) {
+	kw := strings.ToLower(keyword)
+	var newLines []sshdConfigLine
+	for _, v := range values {
+		newLines = append(newLines, sshdConfigLine{
+			raw:     fmt.Sprintf("%s %s", keyword, v),
+			keyword: kw,
+		})
+	}
+
+	pos := -1
+	var out []sshdConfigLine
+	for _, l := range c.lines {
+		if l.match == "" && l.keyword == kw {
+			if pos < 0 {
+				pos = len(out)
+				out = append(out, newLines...)
+			}
+			continue
+		}
+		out = append(out, l)
+	}
+	if pos < 0 {
+		pos = c.insertPosition(out, kw)
+		out = append(out[:pos], append(newLines, out[pos:]...)...)
+	}
+	c.lines = out
+}
+
+// finds where to insert a keyword that is not yet in the global section
+func (c *sshdConfig) insertPosition(lines []sshdConfigLine, kw string) int {
+	firstMatch := len(lines)
+	for i, l := range lines {
+		if l.keyword == "match" {
+			firstMatch = i
+			break
+		}
+	}
+	for i := 0; i < firstMatch; i++ {
+		s := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(lines[i].raw), "#"))
+		if k, _ := splitSSHDLine(s); strings.ToLower(k) == kw && lines[i].keyword == "" {
+			return i + 1
+		}
+	}
+	// keep a blank line between the global section and the first Match block
+	if firstMatch > 0 && firstMatch < len(lines) && strings.TrimSpace(lines[firstMatch-1].raw) == "" {
+		return firstMatch - 1
+	}
+	return firstMatch
+}
+
+// SetMatch adds a Match block, replacing an existing block with the same criteria
+func (c *sshdConfig) SetMatch(criteria string, options map[string]MultiString) {
+	m := normalizeMatch(criteria)
+	var out []sshdConfigLine
+	for _, l := range c.lines {
+		if l.match == m {
+			continue
+		}
+		out = append(out, l)
+	}
+	out = append(out, sshdConfigLine{raw: fmt.Sprintf("Match %s", criteria), keyword: "match", match: m})
+	for _, k := range sortedKeys(options) {
+		for _, v := range options[k] {
+			out = append(out, sshdConfigLine{
+				raw:     fmt.Sprintf("\t%s %s", k, v),
+				keyword: strings.ToLower(k),
+				match:   m,
+			})
+		}
+	}
+	c.lines = out
+}
+
+// Bytes renders the configuration
+func (c *sshdConfig) Bytes() []byte {
+	var b strings.Builder
+	for _, l := range c.lines {
+		b.WriteString(l.raw)
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+// returns the keys of an options map in sorted order, for stable output
+func sortedKeys(m map[string]MultiString) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applies the `sshd:` block to sshd_config. The result is validated with
+// `sshd -t` before it replaces the current configuration, so an invalid
+// configuration is never activated.
+func (l *Lift) sshdConfigSetup() error {
+	data, err := ioutil.ReadFile(sshdConfigFile)
+	if err != nil {
+		return err
+	}
+	conf := parseSSHDConfig(data)
+	s := l.Data.SSHDConfig
+
+	kv := l.getSSHDKVMap()
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conf.Set(k, kv[k])
+	}
+	if len(s.AllowUsers) > 0 {
+		conf.Set("AllowUsers", strings.Join(s.AllowUsers, " "))
+	}
+	if len(s.AllowGroups) > 0 {
+		conf.Set("AllowGroups", strings.Join(s.AllowGroups, " "))
+	}
+	if len(s.Ciphers) > 0 {
+		conf.Set("Ciphers", strings.Join(s.Ciphers, ","))
+	}
+	if len(s.KexAlgorithms) > 0 {
+		conf.Set("KexAlgorithms", strings.Join(s.KexAlgorithms, ","))
+	}
+	if len(s.MACs) > 0 {
+		conf.Set("MACs", strings.Join(s.MACs, ","))
+	}
+	for _, k := range sortedKeys(s.Options) {
+		conf.Set(k, s.Options[k]...)
+	}
+	for _, m := range s.Match {
+		conf.SetMatch(m.Criteria, m.Options)
+	}
+
+	return installSSHDConfig(conf.Bytes())
+}
+
+// writes the new sshd_config next to the current one, validates it
+// with `sshd -t` and atomically renames it into place
+func installSSHDConfig(data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(sshdConfigFile); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return atomicfile.Write(sshdConfigFile, data, mode, func(tmp string) error {
+		log.Debug("Validating sshd configuration")
+		if out, err := exec.Command("sshd", "-t", "-f", tmp).CombinedOutput(); err != nil {
+			return fmt.Errorf("invalid sshd configuration, keeping current: %s", strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+}
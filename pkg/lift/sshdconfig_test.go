@@ -0,0 +1,111 @@
+package lift
+
+import (
+	"testing"
+)
+
+func TestSSHDConfigSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		keyword string
+		values  []string
+		want    string
+	}{
+		{
+			name:    "replace case-insensitively",
+			in:      "port 22\nPermitRootLogin yes\n",
+			keyword: "Port",
+			values:  []string{"2222"},
+			want:    "Port 2222\nPermitRootLogin yes\n",
+		},
+		{
+			name:    "after commented default",
+			in:      "#Port 22\n#AddressFamily any\nPermitRootLogin yes\n",
+			keyword: "Port",
+			values:  []string{"2222"},
+			want:    "#Port 22\nPort 2222\n#AddressFamily any\nPermitRootLogin yes\n",
+		},
+		{
+			name:    "no substring match",
+			in:      "PortForwarding no\n",
+			keyword: "Port",
+			values:  []string{"2222"},
+			want:    "PortForwarding no\nPort 2222\n",
+		},
+		{
+			name:    "before first Match block",
+			in:      "PermitRootLogin no\n\nMatch User backup\n\tPasswordAuthentication yes\n",
+			keyword: "PasswordAuthentication",
+			values:  []string{"no"},
+			want:    "PermitRootLogin no\nPasswordAuthentication no\n\nMatch User backup\n\tPasswordAuthentication yes\n",
+		},
+		{
+			name:    "Match block untouched",
+			in:      "X11Forwarding no\nMatch User alice\n\tX11Forwarding yes\n",
+			keyword: "X11Forwarding",
+			values:  []string{"yes"},
+			want:    "X11Forwarding yes\nMatch User alice\n\tX11Forwarding yes\n",
+		},
+		{
+			name:    "multiple values",
+			in:      "ListenAddress 0.0.0.0\nPort 22\nListenAddress ::\n",
+			keyword: "ListenAddress",
+			values:  []string{"10.0.0.1", "10.0.0.2"},
+			want:    "ListenAddress 10.0.0.1\nListenAddress 10.0.0.2\nPort 22\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := parseSSHDConfig([]byte(tt.in))
+			c.Set(tt.keyword, tt.values...)
+			if got := string(c.Bytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHDConfigSetMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		criteria string
+		options  map[string]MultiString
+		want     string
+	}{
+		{
+			name:     "appended",
+			in:       "PermitRootLogin no\n",
+			criteria: "User backup",
+			options:  map[string]MultiString{"PasswordAuthentication": {"yes"}, "AllowTcpForwarding": {"no"}},
+			want:     "PermitRootLogin no\nMatch User backup\n\tAllowTcpForwarding no\n\tPasswordAuthentication yes\n",
+		},
+		{
+			name:     "replaces block with same criteria",
+			in:       "PermitRootLogin no\nMatch user  backup\n\tPasswordAuthentication no\nMatch Group admin\n\tX11Forwarding yes\n",
+			criteria: "User backup",
+			options:  map[string]MultiString{"PasswordAuthentication": {"yes"}},
+			want:     "PermitRootLogin no\nMatch Group admin\n\tX11Forwarding yes\nMatch User backup\n\tPasswordAuthentication yes\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := parseSSHDConfig([]byte(tt.in))
+			c.SetMatch(tt.criteria, tt.options)
+			if got := string(c.Bytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHDConfigSetAfterSetMatch(t *testing.T) {
+	c := parseSSHDConfig([]byte("PermitRootLogin no\n"))
+	c.SetMatch("User backup", map[string]MultiString{"PasswordAuthentication": {"yes"}})
+	c.Set("PasswordAuthentication", "no")
+	want := "PermitRootLogin no\nPasswordAuthentication no\nMatch User backup\n\tPasswordAuthentication yes\n"
+	if got := string(c.Bytes()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
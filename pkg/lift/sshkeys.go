@@ -0,0 +1,78 @@
+package lift
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// default base URLs of the ssh_import_id key sources; these can be
+	// overridden (or extended) with `ssh_key_sources:` in alpine-data
+	defaultSSHKeySources = map[string]string{
+		"gh": "https://github.com",
+		"gl": "https://gitlab.com",
+	}
+)
+
+// resolves ssh_import_id identifiers (e.g. gh:alice, gl:bob or a plain URL)
+// into authorized_keys lines. Sources that fail are logged and skipped, so
+// one unreachable key server doesn't prevent other keys from being installed.
+func (l *Lift) importSSHKeys(ids []string) []string {
+	var keys []string
+	for _, id := range ids {
+		url, err := l.sshKeySourceURL(id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"id":  id,
+			"url": url,
+		}).Debug("Importing SSH keys")
+		data, err := downloadFile(url, nil)
+		if err != nil {
+			log.Errorf("Error importing SSH keys for %s: %v", id, err)
+			continue
+		}
+		found := parseAuthorizedKeys(data)
+		if len(found) == 0 {
+			log.Warnf("No SSH keys found for %s", id)
+		}
+		keys = append(keys, found...)
+	}
+	return keys
+}
+
+// returns the URL to fetch the keys of an ssh_import_id identifier from
+func (l *Lift) sshKeySourceURL(id string) (string, error) {
+	if strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://") {
+		return id, nil
+	}
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid ssh_import_id %s", id)
+	}
+	base, ok := l.Data.SSHKeySources[parts[0]]
+	if !ok {
+		base, ok = defaultSSHKeySources[parts[0]]
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown ssh_import_id source %s", parts[0])
+	}
+	return fmt.Sprintf("%s/%s.keys", strings.TrimSuffix(base, "/"), parts[1]), nil
+}
+
+// returns the non-empty, non-comment lines of an authorized_keys file
+func parseAuthorizedKeys(data []byte) []string {
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
@@ -0,0 +1,101 @@
+package lift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	stateDir  = "/var/lib/lift"
+	stateFile = stateDir + "/state.yaml"
+)
+
+// liftState is what lift remembers between runs
+type liftState struct {
+	// instance that was fully configured by lift
+	InstanceID string    `yaml:"instance_id"`
+	Completed  time.Time `yaml:"completed"`
+	// per-once scripts that have run
+	Once []string `yaml:"once"`
+}
+
+// reads the lift state. A missing or unreadable state is treated as a
+// first boot.
+func loadState() *liftState {
+	s := &liftState{}
+	b, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return s
+	}
+	if err = yaml.Unmarshal(b, s); err != nil {
+		log.Warnf("Ignoring invalid lift state %s: %v", stateFile, err)
+		return &liftState{}
+	}
+	return s
+}
+
+// records the instance as configured
+func (l *Lift) completeInstance() error {
+	l.state.InstanceID = l.instanceID()
+	l.state.Completed = time.Now().UTC()
+	return l.saveState()
+}
+
+// writes the lift state
+func (l *Lift) saveState() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(l.state)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(stateFile, b, 0600, -1, -1); err != nil {
+		return err
+	}
+	l.persist(stateDir)
+	return nil
+}
+
+// returns the id of this instance: the instance_id from alpine-data, or
+// else a hash of the alpine-data, so changed alpine-data is applied again
+func (l *Lift) instanceID() string {
+	if l.Data.InstanceID != "" {
+		return l.Data.InstanceID
+	}
+	sum := sha256.Sum256(l.rawData)
+	return hex.EncodeToString(sum[:])
+}
+
+// checks if this instance has been configured by an earlier run
+func (l *Lift) configured() bool {
+	return l.state.InstanceID != "" && l.state.InstanceID == l.instanceID()
+}
+
+// checks if a per-once script has run
+func (s *liftState) ranOnce(name string) bool {
+	for _, n := range s.Once {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runs the tasks that are due on every boot of an instance that is
+// already configured
+func (l *Lift) perBootSetup() error {
+	if l.Data.BootCMDEveryBoot {
+		log.Info("Executing boot commands")
+		if err := l.runCommands("bootcmd", l.Data.BootCMD); err != nil {
+			return err
+		}
+	}
+	return l.runScripts(perBootScripts)
+}
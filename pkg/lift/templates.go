@@ -1,6 +1,7 @@
 package lift
 
 import (
+	"bytes"
 	"io/ioutil"
 	"strings"
 	"text/template"
@@ -10,18 +11,31 @@ import (
 
 const (
 	answerFileTemplate = `KEYMAPOPTS="{{ .Keymap }}"
-	{{ $h := split .Network.HostName "." -}}
-	HOSTNAMEOPTS="-n {{ index $h 0 }}"
-	INTERFACESOPTS="{{ .Network.InterfaceOpts }}"
-	DNSOPTS="-d {{ .Network.ResolvConf.Domain }} {{range .Network.ResolvConf.NameServers}}{{.}}{{end}}"
-	TIMEZONEOPTS="-z {{ .TimeZone }}"
-	PROXYOPTS="{{ .Network.Proxy }}"
-	APKREPOSOPTS="-1"
-	SSHDOPTS="-c openssh"
-	NTPOPTS="-c none"
-	DISKOPTS={{- if .ScratchDisk -}}"-q -m data {{ .ScratchDisk -}}"{{- else -}}"none"{{- end }}
-	LBUOPTS="none"
-	APKCACHEOPTS="none"
+HOSTNAMEOPTS="-n {{ .HostName }}"
+INTERFACESOPTS="{{ .Interfaces }}"
+DNSOPTS="{{ .DNS }}"
+TIMEZONEOPTS="-z {{ .TimeZone }}"
+PROXYOPTS="{{ .Proxy }}"
+APKREPOSOPTS="{{ .APKRepos }}"
+USEROPTS="none"
+SSHDOPTS="-c openssh"
+NTPOPTS="-c {{ .NTP }}"
+DISKOPTS="{{ .Disk }}"
+LBUOPTS="none"
+APKCACHEOPTS="none"
+`
+
+	liftServiceTemplate = `#!/sbin/openrc-run
+
+name=lift
+description="Lift first boot configuration"
+command=/usr/local/bin/lift
+command_args="-s {{ . }}"
+
+depend() {
+	need net
+	after firstboot
+}
 `
 
 	drpcliServiceTemplate = `#!/sbin/openrc-run
@@ -77,20 +91,20 @@ const (
 
 	repositoriesTemplate = "{{ range . }}{{ . }}\n{{ end }}"
 
-	chronyTemplate = `{{ if .Network.NTP.Pools }}
-{{ range .Network.NTP.Pools }}
-pool {{.}} iburst maxsources 3
-{{ end }}
-initstepslew 10 {{ index .Network.NTP.Pools 0 }}
+	chronyTemplate = `{{ range .Pools }}pool {{ .Address }}{{ .Options }}
+{{ end }}{{ range .Servers }}server {{ .Address }}{{ .Options }}
 {{ end }}
-{{ if .Network.NTP.Servers }}
-{{ range .Network.NTP.Servers }}
-server {{.}} iburst maxsources 3
-{{ end }}
-initstepslew 10 {{ index .Network.NTP.Servers 0 }}
-{{ end }}
-driftfile /var/lib/chrony/chrony.drift
-rtcsync`
+makestep {{ printf "%g" .MakeStep.Threshold }} {{ .MakeStep.Limit }}
+{{ range .Allow }}allow {{ . }}
+{{ end }}{{ range .Deny }}deny {{ . }}
+{{ end }}driftfile /var/lib/chrony/chrony.drift
+{{ if .RTCSync }}rtcsync
+{{ end }}`
+
+	openntpdTemplate = `{{ range .Pools }}servers {{ .Address }}
+{{ end }}{{ range .Servers }}server {{ .Address }}
+{{ end }}{{ if .Allow }}listen on *
+{{ end }}`
 
 	ssmtpTemplate = `hostname={{ .Network.HostName }}
 {{ if .MTA.Root }}root={{ .MTA.Root }}{{ end }}
@@ -103,22 +117,74 @@ rtcsync`
 {{ if .MTA.RewriteDomain }}rewriteDomain={{ .MTA.RewriteDomain }}{{ end }}
 {{ if .MTA.FromLineOverride }}FromLineOverride=Yes{{ end }}
 `
+
+	unboundTemplate = `server:
+	interface: 127.0.0.1
+	interface: ::1
+	do-ip6: yes
+
+forward-zone:
+	name: "."
+{{ range . }}	forward-addr: {{ . }}
+{{ end }}`
+
+	dnsmasqTemplate = `listen-address=127.0.0.1,::1
+bind-interfaces
+no-resolv
+domain-needed
+bogus-priv
+{{ range . }}server={{ . }}
+{{ end }}conf-dir=/etc/dnsmasq.d/,*.conf
+`
+
+	proxyProfileTemplate = `# Generated by lift
+{{ if .HTTP }}export http_proxy="{{ .HTTP }}"
+export HTTP_PROXY="{{ .HTTP }}"
+{{ end }}{{ if .HTTPS }}export https_proxy="{{ .HTTPS }}"
+export HTTPS_PROXY="{{ .HTTPS }}"
+{{ end }}{{ if .NoProxy }}export no_proxy="{{ join .NoProxy "," }}"
+export NO_PROXY="{{ join .NoProxy "," }}"
+{{ end }}`
+
+	msmtpTemplate = `defaults
+syslog LOG_MAIL
+{{ if .AliasesFile }}aliases {{ .AliasesFile }}
+{{ end }}{{ if or .MTA.UseTLS .MTA.UseSTARTTLS }}tls on
+tls_trust_file /etc/ssl/certs/ca-certificates.crt
+tls_starttls {{ if .MTA.UseTLS }}off{{ else }}on{{ end }}
+{{ end }}
+account default
+host {{ .Host }}
+port {{ .Port }}
+{{ if .MTA.RewriteDomain }}maildomain {{ .MTA.RewriteDomain }}
+{{ end }}{{ if .MTA.User }}auth {{ if .MTA.AuthMethod }}{{ lower .MTA.AuthMethod }}{{ else }}on{{ end }}
+user {{ .MTA.User }}
+password {{ .MTA.Password }}
+{{ end }}`
 )
 
 var (
-	tplFuncMap                                              = make(template.FuncMap)
-	answerFile, drpcliInit, repoFile, chronyConf, ssmtpConf *template.Template
+	tplFuncMap                                                                                                                         = make(template.FuncMap)
+	answerFile, drpcliInit, repoFile, chronyConf, openntpdConf, ssmtpConf, msmtpConf, unboundConf, dnsmasqConf, proxyProfile, liftInit *template.Template
 )
 
 func init() {
 	// Initialise parser functions
 	tplFuncMap["split"] = Split
 	tplFuncMap["upper"] = Upper
+	tplFuncMap["lower"] = strings.ToLower
+	tplFuncMap["join"] = strings.Join
 	answerFile = template.Must(template.New("answerfile").Funcs(tplFuncMap).Parse(answerFileTemplate))
 	drpcliInit = template.Must(template.New("drpcli").Funcs(tplFuncMap).Parse(drpcliServiceTemplate))
 	repoFile = template.Must(template.New("repositories").Funcs(tplFuncMap).Parse(repositoriesTemplate))
 	chronyConf = template.Must(template.New("chrony").Funcs(tplFuncMap).Parse(chronyTemplate))
+	openntpdConf = template.Must(template.New("openntpd").Funcs(tplFuncMap).Parse(openntpdTemplate))
 	ssmtpConf = template.Must(template.New("ssmtp").Funcs(tplFuncMap).Parse(ssmtpTemplate))
+	msmtpConf = template.Must(template.New("msmtp").Funcs(tplFuncMap).Parse(msmtpTemplate))
+	unboundConf = template.Must(template.New("unbound").Funcs(tplFuncMap).Parse(unboundTemplate))
+	dnsmasqConf = template.Must(template.New("dnsmasq").Funcs(tplFuncMap).Parse(dnsmasqTemplate))
+	proxyProfile = template.Must(template.New("proxy").Funcs(tplFuncMap).Parse(proxyProfileTemplate))
+	liftInit = template.Must(template.New("lift").Funcs(tplFuncMap).Parse(liftServiceTemplate))
 }
 
 // This function takes a template and data struct, executes (parses) the template
@@ -156,3 +222,22 @@ func Split(s string, d string) []string {
 func Upper(s string) string {
 	return strings.ToUpper(s)
 }
+
+// templateContext is the data available to templated write_files content
+type templateContext struct {
+	Facts *Facts
+	Data  *AlpineData
+}
+
+// renders content as a text/template, with the instance facts and alpine-data
+func (l *Lift) renderContent(name string, content []byte) ([]byte, error) {
+	t, err := template.New(name).Funcs(tplFuncMap).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, templateContext{Facts: l.getFacts(), Data: l.Data}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -1,61 +1,25 @@
 package lift
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Constants for service states
 const (
-	START   = "start"
-	RESTART = "restart"
-	STOP    = "stop"
-	RELOAD  = "reload"
-	ZAP     = "zap"
+	sudoersDir = "/etc/sudoers.d"
+	doasDir    = "/etc/doas.d"
 )
 
-// rewrites a config file with values from alpine-data
-func parseConfigFile(path, sep string, kv map[string]string) error {
-	conf, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	out := findReplace(conf, sep, kv)
-	err = ioutil.WriteFile(path, out, 0644)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Terribly inefficient way to find keys and replace them with
-// our own value... Refactor at a later point in time...
-// sep defines the separator (typically " ", ":" or "=")
-// This function uses exact (case-sensitive) match on purpose.
-func findReplace(conf []byte, sep string, kv map[string]string) []byte {
-	lines := strings.Split(string(conf), "\n")
-	for k, v := range kv {
-		found := false
-		for i, l := range lines {
-			if !strings.HasPrefix(l, "#") && strings.Contains(l, k) {
-				lines[i] = fmt.Sprintf("%s%s%s", k, sep, v)
-				found = true
-			}
-		}
-		if !found {
-			lines = append(lines, fmt.Sprintf("%s%s%s", k, sep, v))
-		}
-	}
-	out := strings.Join(lines, "\n")
-	return []byte(out)
-}
+var (
+	sudoersFileName = strings.NewReplacer(".", "_", "~", "_")
+)
 
 // this function takes a path to a file, and tries to
 // open it, creating it if it doesn't exist.
@@ -87,17 +51,10 @@ func openOrCreate(path string) (*os.File, error) {
 	return file, nil
 }
 
-// interact with openrc to start, stop, restart or reload a service
-func doService(name string, action string) error {
-	cmd := exec.Command("service", name, action)
-	err := cmd.Run()
-	return err
-}
-
 // Creates an OS user
-func createOSUser(u User) error {
-	args := []string{u.Name}
-	var input []byte
+func (l *Lift) createOSUser(u User) error {
+	// The password is never passed to adduser; it is set afterwards by chpasswd
+	args := []string{"-D", u.Name}
 
 	if u.NoCreateHomeDir {
 		args = append([]string{"-H"}, args...)
@@ -113,23 +70,27 @@ func createOSUser(u User) error {
 	if u.System {
 		args = append([]string{"-S"}, args...)
 	}
-	if u.Password != "" {
-		input = []byte(fmt.Sprintf("%s\n%s\n", u.Password, u.Password))
-	} else {
-		args = append([]string{"-D"}, args...)
-	}
 	if u.Shell != "" {
 		args = append([]string{"-s", u.Shell}, args...)
 	}
 
 	cmd := exec.Command("adduser", args...)
-	if len(input) > 0 {
-		cmd.Stdin = bytes.NewBuffer(input)
-	}
 	err := cmd.Run()
 	if err != nil {
 		log.Debugf("Error creating user %s: %s", u.Name, err)
 	}
+	created := err == nil
+
+	if u.HashedPassword != "" {
+		if err = setPassword(u.Name, u.HashedPassword, true); err != nil {
+			return err
+		}
+	} else if u.Password != "" {
+		log.Warnf("Cleartext password for user %s in alpine-data; consider using hashed_passwd", u.Name)
+		if err = setPassword(u.Name, u.Password, false); err != nil {
+			return err
+		}
+	}
 
 	if u.Groups != nil && len(u.Groups) > 0 {
 		for _, g := range u.Groups {
@@ -142,11 +103,10 @@ func createOSUser(u User) error {
 	}
 
 	if u.SSHAuthorizedKeys != nil && len(u.SSHAuthorizedKeys) > 0 {
-		cmd := exec.Command("grep", u.Name, "/etc/passwd")
-		var b bytes.Buffer
-		cmd.Stdout = &b
-		_ = cmd.Run()
-		homeDir := strings.Split(b.String(), ":")[5]
+		homeDir, err := userHomeDir(u.Name)
+		if err != nil {
+			return err
+		}
 		sshDir := fmt.Sprintf("%s/.ssh", homeDir)
 		authKeysFile := fmt.Sprintf("%s/authorized_keys", sshDir)
 		file, err := openOrCreate(authKeysFile)
@@ -160,9 +120,165 @@ func createOSUser(u User) error {
 		}
 	}
 
-	// finally unlock
-	cmd = exec.Command("passwd", "-u", u.Name)
-	_ = cmd.Run()
+	// finally lock or unlock. adduser -D leaves "!", which Alpine's sshd
+	// (without PAM) treats as a locked account, blocking key based logins
+	// as well, while unlocking it results in an empty password. "*"
+	// disables password logins but keeps the account usable.
+	if u.LockPassword {
+		log.Debugf("Disabling password login of %s", u.Name)
+		if err = chpasswd(u.Name, "*", true); err != nil {
+			return err
+		}
+	} else if u.HashedPassword != "" || u.Password != "" {
+		_ = exec.Command("passwd", "-u", u.Name).Run()
+	} else if hash, _ := shadowPassword(u.Name); created || hash == "!" {
+		// existing accounts keep the password they were given since
+		log.Debugf("Disabling password login of %s", u.Name)
+		if err = chpasswd(u.Name, "*", true); err != nil {
+			return err
+		}
+	}
+
+	if err = l.setPasswordExpiry(u); err != nil {
+		return err
+	}
+
+	if len(u.Sudo) > 0 {
+		if err = l.writeSudoRules(u); err != nil {
+			return err
+		}
+	}
+	if len(u.Doas) > 0 {
+		if err = l.writeDoasRules(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sets a user's password through chpasswd, either from cleartext
+// or from a SHA-512 crypt(3) hash
+func setPassword(user, password string, hashed bool) error {
+	if hashed && !isSHA512Crypt(password) {
+		return fmt.Errorf("password hash for %s is not a SHA-512 crypt hash", user)
+	}
+	return chpasswd(user, password, hashed)
+}
+
+// sets a password, or an encrypted password string, with chpasswd
+func chpasswd(user, password string, encrypted bool) error {
+	return chpasswdIn("", user, password, encrypted)
+}
+
+// sets a password with chpasswd, chrooted into root when it is not empty
+func chpasswdIn(root, user, password string, encrypted bool) error {
+	args := []string{"chpasswd"}
+	if encrypted {
+		args = append(args, "-e")
+	}
+	if root != "" {
+		args = append([]string{"chroot", root}, args...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s\n", user, password))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("setting password for %s: %v", user, err)
+	}
+	return nil
+}
+
+// checks for the $6$[rounds=N$]salt$hash format
+func isSHA512Crypt(s string) bool {
+	if !strings.HasPrefix(s, "$6$") {
+		return false
+	}
+	parts := strings.Split(s[3:], "$")
+	if len(parts) == 3 && strings.HasPrefix(parts[0], "rounds=") {
+		parts = parts[1:]
+	}
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// applies password expiry settings with chage (from the shadow package)
+func (l *Lift) setPasswordExpiry(u User) error {
+	var args []string
+	if u.ExpirePassword {
+		args = append(args, "-d", "0")
+	}
+	if u.PasswordMaxAge > 0 {
+		args = append(args, "-M", strconv.Itoa(u.PasswordMaxAge))
+	}
+	if u.ExpireDate != "" {
+		args = append(args, "-E", u.ExpireDate)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	if err := l.apkAdd("shadow"); err != nil {
+		return err
+	}
+	out, err := exec.Command("chage", append(args, u.Name)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("setting password expiry for %s: %v: %s", u.Name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writes the user's sudo rules to /etc/sudoers.d/<user>, validated by visudo
+func (l *Lift) writeSudoRules(u User) error {
+	if err := l.apkAdd("sudo"); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, rule := range u.Sudo {
+		b.WriteString(fmt.Sprintf("%s %s\n", u.Name, rule))
+	}
+	// sudo skips files in sudoers.d with a '.' in their name, or ending with '~'
+	path := filepath.Join(sudoersDir, sudoersFileName.Replace(u.Name))
+	if err := writeRulesFile(path, b.String()); err != nil {
+		return err
+	}
+	if out, err := exec.Command("visudo", "-c", "-f", path).CombinedOutput(); err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("invalid sudo rules for %s: %s", u.Name, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
 
+// writes the user's doas rules to /etc/doas.d/<user>.conf, validated by doas -C.
+// Rules are written as is, so they should include the identity they apply to.
+func (l *Lift) writeDoasRules(u User) error {
+	if err := l.apkAdd("doas"); err != nil {
+		return err
+	}
+	path := filepath.Join(doasDir, fmt.Sprintf("%s.conf", u.Name))
+	if err := writeRulesFile(path, strings.Join(u.Doas, "\n")+"\n"); err != nil {
+		return err
+	}
+	if out, err := exec.Command("doas", "-C", path).CombinedOutput(); err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("invalid doas rules for %s: %s", u.Name, strings.TrimSpace(string(out)))
+	}
 	return nil
 }
+
+// writes a sudo/doas rules file, readable by root only
+func writeRulesFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	log.Debugf("Writing %s", path)
+	return ioutil.WriteFile(path, []byte(content), 0440)
+}
+
+// returns the home directory of a user, as found in /etc/passwd
+func userHomeDir(name string) (string, error) {
+	u, err := lookupPasswd(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Home, nil
+}